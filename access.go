@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"strings"
+)
+
+// cidrList 实现了 flag.Value，可重复指定或用逗号分隔，每一项是 CIDR（如 10.0.0.0/8），也可以是单个 IP
+type cidrList []*net.IPNet
+
+func (c *cidrList) String() string {
+	parts := make([]string, len(*c))
+	for i, n := range *c {
+		parts[i] = n.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (c *cidrList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return errors.New("invalid IP or CIDR: " + item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			*c = append(*c, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return err
+		}
+		*c = append(*c, n)
+	}
+	return nil
+}
+
+func (c cidrList) contains(ip net.IP) bool {
+	for _, n := range c {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowCIDRs 为空表示允许所有来源，denyCIDRs 优先于 allowCIDRs
+var allowCIDRs, denyCIDRs cidrList
+
+func init() {
+	flag.Var(&allowCIDRs, "allow-cidr", "只接受来自这些网段的连接，格式为 CIDR 或 IP，可重复指定或用逗号分隔，不指定时接受所有来源")
+	flag.Var(&denyCIDRs, "deny-cidr", "拒绝来自这些网段的连接，格式为 CIDR 或 IP，可重复指定或用逗号分隔，优先于 -allow-cidr")
+}
+
+// remoteIP 取出连接的对端 IP，UNIX socket 等没有 IP 的连接返回 nil
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// allowConn 在 handleConn 登记用户之前按 -deny-cidr、-allow-cidr 检查连接来源，拒绝时记录日志
+// UNIX socket 只有本机能连上，不受这两个参数限制
+func allowConn(conn net.Conn) bool {
+	ip := remoteIP(conn)
+	if ip == nil {
+		return true
+	}
+	switch {
+	case denyCIDRs.contains(ip):
+		log.Printf("拒绝来自 %s 的连接：在 -deny-cidr 中", ip)
+		return false
+	case len(allowCIDRs) > 0 && !allowCIDRs.contains(ip):
+		log.Printf("拒绝来自 %s 的连接：不在 -allow-cidr 中", ip)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	adminPass     = flag.String("admin-pass", "", "管理员口令，用户通过 /oper <口令> 成为管理员，为空表示不允许这样提权")
+	adminHandover = flag.Bool("admin-handover", false, "最后一个管理员离开时，自动把在线时间最长的用户提升为管理员")
+)
+
+func init() {
+	registerCommand(&command{
+		name:    "oper",
+		usage:   "/oper <password>",
+		desc:    "使用管理员口令成为管理员",
+		handler: cmdOper,
+	})
+	registerCommand(&command{
+		name:      "grantadmin",
+		usage:     "/grantadmin <id>",
+		desc:      "把用户提升为管理员",
+		adminOnly: true,
+		handler:   cmdGrantAdmin,
+	})
+	registerCommand(&command{
+		name:      "revokeadmin",
+		usage:     "/revokeadmin <id>",
+		desc:      "取消用户的管理员身份",
+		adminOnly: true,
+		handler:   cmdRevokeAdmin,
+	})
+	registerCommand(&command{
+		name:      "export",
+		usage:     "/export users|commands",
+		desc:      "以 JSON 数组导出在线用户或命令目录，供工具使用",
+		adminOnly: true,
+		handler:   cmdExport,
+	})
+}
+
+// userInfo 是 /export users 输出的单个用户信息
+type userInfo struct {
+	ID      int       `json:"id"`
+	Nick    string    `json:"nick"`
+	Addr    string    `json:"addr"`
+	EnterAt time.Time `json:"enter_at"`
+	Room    string    `json:"room"`
+}
+
+func (s *chatState) isAdmin(user *User) bool {
+	_, ok := s.admins[user]
+	return ok
+}
+
+// requireAdmin 检查用户是否为管理员，不是时以 command 失败的形式告知用户并返回 false
+func (s *chatState) requireAdmin(user *User, command string) bool {
+	if s.isAdmin(user) {
+		return true
+	}
+	s.fail(user, command, "permission denied: admin only")
+	return false
+}
+
+// removeAdmin 在用户离开时撤销其管理员身份，必要时把管理员身份交给在线时间最长的用户
+func (s *chatState) removeAdmin(user *User) {
+	if !s.isAdmin(user) {
+		return
+	}
+	delete(s.admins, user)
+	if len(s.admins) > 0 || !*adminHandover || len(s.users) == 0 {
+		return
+	}
+
+	heir := longestConnected(s.users)
+	s.admins[heir] = struct{}{}
+	s.send(heir, "the last admin has left, you are now an admin")
+}
+
+func cmdOper(user *User, args string) {
+	if *adminPass == "" || subtle.ConstantTimeCompare([]byte(args), []byte(*adminPass)) != 1 {
+		replyError(user, "oper", "permission denied: wrong password")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		s.admins[user] = struct{}{}
+		s.send(user, "you are now an admin")
+	}
+}
+
+func cmdGrantAdmin(user *User, args string) {
+	id, err := strconv.Atoi(args)
+	if err != nil {
+		replyError(user, "grantadmin", "usage: /grantadmin <id>")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "grantadmin") {
+			return
+		}
+		target := s.userByID(id)
+		if target == nil {
+			s.fail(user, "grantadmin", "no such user: "+args)
+			return
+		}
+		if s.isAdmin(target) {
+			s.fail(user, "grantadmin", "user "+args+" is already an admin")
+			return
+		}
+		s.admins[target] = struct{}{}
+		s.send(user, "user "+args+" is now an admin")
+		s.send(target, "user:`"+user.displayName()+"` made you an admin")
+	}
+}
+
+func cmdRevokeAdmin(user *User, args string) {
+	id, err := strconv.Atoi(args)
+	if err != nil {
+		replyError(user, "revokeadmin", "usage: /revokeadmin <id>")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "revokeadmin") {
+			return
+		}
+		target := s.userByID(id)
+		if target == nil || !s.isAdmin(target) {
+			s.fail(user, "revokeadmin", "user "+args+" is not an admin")
+			return
+		}
+		delete(s.admins, target)
+		s.send(user, "user "+args+" is no longer an admin")
+		if target != user {
+			s.send(target, "user:`"+user.displayName()+"` revoked your admin privileges")
+		}
+	}
+}
+
+// cmdExport 在 broadcaster 中生成在线用户的快照或命令目录并编码成一行 JSON，只发给调用者
+func cmdExport(user *User, args string) {
+	if args != "users" && args != "commands" {
+		replyError(user, "export", "usage: /export users|commands")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "export") {
+			return
+		}
+		var v any = commandCatalog()
+		if args == "users" {
+			infos := make([]userInfo, 0, len(s.users))
+			for u := range s.users {
+				infos = append(infos, userInfo{ID: u.ID, Nick: u.Nick, Addr: u.Addr, EnterAt: u.EnterAt, Room: u.Room})
+			}
+			sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+			v = infos
+		}
+
+		data, err := json.Marshal(v)
+		if err != nil {
+			s.fail(user, "export", "export failed: "+err.Error())
+			return
+		}
+		s.send(user, string(data))
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"slices"
+	"strconv"
+	"time"
+)
+
+var (
+	maxUsers    = flag.Int("max-users", 0, "同时在线的最大用户数，0 表示不限制")
+	queueDepth  = flag.Int("queue", 0, "在线人数已满时最多排队等待的连接数，0 表示直接拒绝")
+	queueNotice = flag.Duration("queue-notice", 30*time.Second, "定期提醒排队用户当前位置的间隔")
+)
+
+// admit 处理新用户的进入请求：人数未满时直接登记，已满时放入等待队列，队列也满了则拒绝
+// 处理结果通过 user.admitted 告知 handleConn
+func (s *chatState) admit(user *User) {
+	if shuttingDown.Load() {
+		s.send(user, "server is shutting down")
+		user.admitted <- false
+		user.closeChannels()
+		return
+	}
+	if *maxUsers <= 0 || len(s.users) < *maxUsers {
+		s.register(user)
+		return
+	}
+	if len(s.waiting) < *queueDepth {
+		s.waiting = append(s.waiting, user)
+		s.send(user, "server is full, you are position "+strconv.Itoa(len(s.waiting))+" in queue")
+		user.queued <- struct{}{}
+		return
+	}
+
+	s.send(user, "server is full, please try again later")
+	user.admitted <- false
+	user.closeChannels()
+}
+
+// leaveQueue 把已经断开的排队用户移出等待队列并拒绝，之后的用户前移；用户已经被放行时什么也不做，由读循环照常注销
+func (s *chatState) leaveQueue(user *User) {
+	i := slices.Index(s.waiting, user)
+	if i < 0 {
+		return
+	}
+	s.waiting = slices.Delete(s.waiting, i, i+1)
+	user.admitted <- false
+	user.closeChannels()
+	s.notifyWaiting()
+}
+
+// waitAdmission 在 handleConn 中等待登记结果，返回是否允许进入，以及读循环要先等待的一次 Scan 的结果（没有时为 nil）
+// 排队时先归还握手名额，排队的连接不应该挡住新连接的握手；排队期间继续读取输入，
+// 用户断开后能及时离开队列，不会一直占着位置。排队期间的输入不会广播，只提醒用户
+func waitAdmission(user *User, input *bufio.Scanner, release func()) (bool, <-chan bool) {
+	select {
+	case admitted := <-user.admitted:
+		return admitted, nil
+	case <-user.queued:
+	}
+	release()
+
+	// 同一时间只有一次 Scan 在进行，被放行时还没有返回的 Scan 交给读循环等待；
+	// 缓冲为 1，被拒绝后 Scan 才返回时也不会阻塞
+	scanned := make(chan bool, 1)
+	scan := func() {
+		go func() { scanned <- input.Scan() }()
+	}
+	scan()
+	for {
+		select {
+		case admitted := <-user.admitted:
+			return admitted, scanned
+		case ok := <-scanned:
+			if !ok {
+				// broadcaster 可能恰好已经放行了这个用户，这时 admitted 为 true，读循环拿到 false 后立即结束并注销
+				actionChannel <- func(s *chatState) { s.leaveQueue(user) }
+				scanned <- false
+				return <-user.admitted, scanned
+			}
+			actionChannel <- func(s *chatState) {
+				if slices.Contains(s.waiting, user) {
+					s.send(user, "you are still in the queue, message dropped")
+				}
+			}
+			scan()
+		}
+	}
+}
+
+// register 把用户登记到在线列表，默认进入大厅
+// 进入提醒要在登记之前发出，否则自己会收到自己到来的消息提醒
+func (s *chatState) register(user *User) {
+	if !*quietJoins {
+		s.broadcast(&Message{Content: "user:`" + strconv.Itoa(user.ID) + "` has enter"})
+	}
+	s.users[user] = struct{}{}
+	s.stats.totalConnections++
+	s.joinRoom(user, lobbyRoom)
+	if !user.briefGreeting {
+		s.replayHistory(user)
+	}
+	s.sendPinned(user)
+	user.admitted <- true
+}
+
+// promoteWaiting 有空位时按先来后到放行排队的用户，并告知剩下的用户新的位置
+func (s *chatState) promoteWaiting() {
+	promoted := false
+	for len(s.waiting) > 0 && len(s.users) < *maxUsers {
+		user := s.waiting[0]
+		s.waiting = s.waiting[1:]
+		s.register(user)
+		s.send(user, "a slot is free, you have entered the chat")
+		promoted = true
+	}
+	if promoted {
+		s.notifyWaiting()
+	}
+}
+
+// notifyWaiting 告知每个排队用户当前的位置
+func (s *chatState) notifyWaiting() {
+	for i, user := range s.waiting {
+		s.send(user, "you are position "+strconv.Itoa(i+1)+" in queue")
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// 排队的用户不占握手名额，排队期间的输入不会广播，断开后立即离开队列
+func TestQueuedUserDisconnects(t *testing.T) {
+	var maxUsersBefore, queueBefore int
+	inBroadcaster(func(s *chatState) {
+		maxUsersBefore, queueBefore = *maxUsers, *queueDepth
+		*maxUsers, *queueDepth = len(s.users)+1, 1
+	})
+	defer inBroadcaster(func(*chatState) { *maxUsers, *queueDepth = maxUsersBefore, queueBefore })
+
+	a := dial(t)
+	defer a.close(t)
+	a.sync(t, t.Name())
+
+	b := dial(t)
+	b.expect(t, "position 1 in queue")
+	select {
+	case <-b.release:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued user still holds the handshake slot")
+	}
+	b.send(t, "hello from the queue")
+	b.expect(t, "still in the queue")
+
+	b.close(t)
+	var waiting int
+	inBroadcaster(func(s *chatState) { waiting = len(s.waiting) })
+	if waiting != 0 {
+		t.Fatalf("%d users still waiting after the queued user disconnected", waiting)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 运维人员可以配置简单的自动回复规则，把服务端当成常见问题机器人，例如 -auto-reply '^!rules$=>请保持友善'
+// 规则在用户发言时按配置顺序检查，匹配的第一条生效；触发规则的消息本身照常广播，回复在它之后送达
+// Go 的 regexp 基于 RE2，匹配时间和输入长度成线性关系，不会出现灾难性回溯；这里再限制规则数和正则长度
+const (
+	maxAutoReplies      = 32
+	maxAutoReplyPattern = 256
+)
+
+// autoReplyRule 是一条自动回复规则：用户消息匹配 pattern 时回复 reply
+type autoReplyRule struct {
+	pattern   *regexp.Regexp
+	reply     string
+	broadcast bool // broadcast 为 true 时回复广播给发言者所在的房间，否则只回复给发言者；
+}
+
+// autoReplyRules 实现了 flag.Value，格式为 <正则>=><回复>，可重复指定
+type autoReplyRules []autoReplyRule
+
+// autoReplies 是所有的自动回复规则，私下回复和广播回复共用一个列表，保持配置的先后顺序
+var autoReplies autoReplyRules
+
+// autoReplyFlag 把 -auto-reply 和 -auto-broadcast 都追加到 autoReplies 中
+type autoReplyFlag struct {
+	broadcast bool
+}
+
+func init() {
+	flag.Var(autoReplyFlag{}, "auto-reply", "自动回复规则，格式为 <正则>=><回复>，用户消息匹配时私下回复给发言者，可重复指定")
+	flag.Var(autoReplyFlag{broadcast: true}, "auto-broadcast", "自动回复规则，格式为 <正则>=><回复>，用户消息匹配时把回复广播给发言者所在的房间，可重复指定")
+}
+
+func (f autoReplyFlag) String() string {
+	parts := make([]string, 0, len(autoReplies))
+	for _, rule := range autoReplies {
+		if rule.broadcast == f.broadcast {
+			parts = append(parts, rule.pattern.String()+"=>"+rule.reply)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (f autoReplyFlag) Set(value string) error {
+	pattern, reply, ok := strings.Cut(value, "=>")
+	if !ok || pattern == "" || reply == "" {
+		return errors.New("expected <regex>=><reply>")
+	}
+	if len(autoReplies) >= maxAutoReplies {
+		return errors.New("too many auto-reply rules, max " + strconv.Itoa(maxAutoReplies))
+	}
+	if len(pattern) > maxAutoReplyPattern {
+		return errors.New("auto-reply pattern is too long, max " + strconv.Itoa(maxAutoReplyPattern) + " bytes")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	autoReplies = append(autoReplies, autoReplyRule{pattern: re, reply: stripControl(reply), broadcast: f.broadcast})
+	return nil
+}
+
+// match 返回第一条匹配 line 的规则，没有匹配时返回 nil
+func (r autoReplyRules) match(line string) *autoReplyRule {
+	for i := range r {
+		if r[i].pattern.MatchString(line) {
+			return &r[i]
+		}
+	}
+	return nil
+}
+
+// autoReply 在 broadcaster 广播用户消息之后调用，有规则匹配时回复，回复因此总是在触发它的消息之后到达；只能在 broadcaster 中调用
+// 被慢速模式拦下的消息不会走到这里，不能借自动回复绕过发言间隔
+func (s *chatState) autoReply(msg *Message) {
+	rule := autoReplies.match(msg.Content)
+	if rule == nil {
+		return
+	}
+	if !rule.broadcast {
+		s.send(msg.From, rule.reply)
+		return
+	}
+	s.broadcast(&Message{Room: msg.Room, Content: "[auto-reply] " + rule.reply})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 被慢速模式拦下的消息不触发自动回复
+func TestAutoReplyRespectsSlowmode(t *testing.T) {
+	var rulesBefore autoReplyRules
+	inBroadcaster(func(*chatState) {
+		rulesBefore = autoReplies
+		autoReplies = nil
+		if err := (autoReplyFlag{}).Set(`^!rules$=>be nice`); err != nil {
+			t.Error(err)
+		}
+	})
+	defer inBroadcaster(func(*chatState) { autoReplies = rulesBefore })
+
+	s := newChatState()
+	defer s.close()
+	user := &User{ID: 1, MessageChannel: make(chan string, 8), priorityChannel: make(chan string, 4)}
+	s.users[user] = struct{}{}
+	s.joinRoom(user, "faq")
+	s.rooms["faq"].slowmode = time.Minute
+
+	now := time.Now()
+	s.handleMessage(&Message{From: user, Content: "!rules", Time: now})
+	s.handleMessage(&Message{From: user, Content: "!rules", Time: now.Add(time.Second)})
+
+	replies, slowed := 0, 0
+	for len(user.MessageChannel) > 0 {
+		line := <-user.MessageChannel
+		switch {
+		case line == "be nice":
+			replies++
+		case strings.HasPrefix(line, "slow mode"):
+			slowed++
+		}
+	}
+	if replies != 1 || slowed != 1 {
+		t.Fatalf("got %d auto-replies and %d slow mode notices, want 1 and 1", replies, slowed)
+	}
+}
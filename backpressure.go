@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// 背压链路：broadcaster 是唯一处理消息的 goroutine，给每个接收者投递时不会阻塞（见 send），
+// 但房间人数很多时单条广播仍是 O(N) 的，broadcaster 处理不过来时 messageChannel 会被写满，
+// 之后每个发消息的 handleConn 都会阻塞在发送上，连带停止读取该连接，最终所有发言的用户都卡住。
+// 这里给等待设置上限：队列满时最多等待 -message-queue-wait，超时后丢弃这条消息并告知发送者，
+// 读循环得以继续（命令、空闲检测照常工作），同时记录次数并定期打印警告，便于发现瓶颈。
+var (
+	messageQueue     = flag.Int("message-queue", 8, "等待 broadcaster 处理的消息队列长度")
+	messageQueueWait = flag.Duration("message-queue-wait", time.Second, "消息队列已满时发送者最多等待的时间，超时后丢弃该消息，0 表示一直等待")
+)
+
+// queueWarnInterval 是队列已满警告的最小间隔，避免持续过载时刷屏
+const queueWarnInterval = 10 * time.Second
+
+// 以下计数会被多个 handleConn goroutine 同时修改，因此使用原子类型，供 /stats 使用
+var (
+	queueFullCount atomic.Int64 // queueFullCount 是发送时消息队列已满的次数；
+	shedCount      atomic.Int64 // shedCount 是因为等待超时而丢弃的消息数；
+	lastQueueWarn  atomic.Int64 // lastQueueWarn 是最近一次打印警告的时间（UnixNano）；
+)
+
+// submitMessage 把用户消息交给 broadcaster，队列已满且等待超时时丢弃消息并返回 false
+func submitMessage(msg *Message) bool {
+	select {
+	case messageChannel <- msg:
+		return true
+	default:
+	}
+
+	full := queueFullCount.Add(1)
+	warnQueueFull(full)
+	if *messageQueueWait == 0 {
+		messageChannel <- msg
+		return true
+	}
+
+	timer := time.NewTimer(*messageQueueWait)
+	defer timer.Stop()
+	select {
+	case messageChannel <- msg:
+		return true
+	case <-timer.C:
+		shedCount.Add(1)
+		return false
+	}
+}
+
+// warnQueueFull 在队列已满时打印警告，每 queueWarnInterval 最多一次
+func warnQueueFull(full int64) {
+	now := time.Now().UnixNano()
+	last := lastQueueWarn.Load()
+	if now-last < int64(queueWarnInterval) || !lastQueueWarn.CompareAndSwap(last, now) {
+		return
+	}
+	log.Printf("broadcaster 处理不过来：消息队列（长度 %d）已满 %d 次，累计丢弃 %d 条消息", cap(messageChannel), full, shedCount.Load())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"runtime"
+	"strings"
+)
+
+var advertiseCaps = flag.Bool("caps", true, "连接建立后先发送一行 caps: 列出服务端开启的功能，供客户端和机器人据此调整行为")
+
+// version 是服务端的版本，构建时通过 -ldflags "-X main.version=v1.2.3" 设置
+var version = "dev"
+
+func init() {
+	registerCommand(&command{
+		name:    "version",
+		usage:   "/version",
+		desc:    "查看服务端的版本和开启的功能",
+		handler: cmdVersion,
+	})
+}
+
+// capabilities 根据启动参数列出服务端支持的功能，按固定顺序排列，格式为 "caps: rooms,history,..."
+func capabilities() string {
+	caps := []string{"rooms", "nick", "mentions", "dnd", "reactions", "format", "errors", "dm"}
+	if *historySize > 0 {
+		caps = append(caps, "history", "edit", "ttl")
+	}
+	if *inboxSize > 0 {
+		caps = append(caps, "offline-inbox")
+	}
+	if limits.Load().rate > 0 {
+		caps = append(caps, "rate-limit")
+	}
+	if *adminPass != "" {
+		caps = append(caps, "oper")
+	}
+	if *hmacKey != "" {
+		caps = append(caps, "hmac")
+	}
+	if *challenge {
+		caps = append(caps, "challenge")
+	}
+	if *idleTimeout > 0 {
+		caps = append(caps, "idle-timeout")
+	}
+	return "caps: " + strings.Join(caps, ",")
+}
+
+// cmdVersion 随时回复版本和功能列表，第二行和连接时发送的 caps: 行格式相同
+func cmdVersion(user *User, _ string) {
+	user.MessageChannel <- "version: " + version + " (" + runtime.Version() + ")\n" + capabilities()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	challenge        = flag.Bool("challenge", false, "新连接需要先输入服务端给出的单词才能进入聊天室，用于阻挡简单的机器人（非交互式客户端将无法进入）")
+	challengeTimeout = flag.Duration("challenge-timeout", 30*time.Second, "回答验证单词的超时时间")
+)
+
+// challengeWords 是验证时随机挑选的单词
+var challengeWords = []string{"apple", "banana", "cherry", "grape", "lemon", "mango", "orange", "peach"}
+
+// passChallenge 要求用户在超时前原样输入一个随机单词，回答错误或超时返回 false
+// 使用和之后读取消息相同的 scanner，避免预读的数据丢失
+func passChallenge(user *User, conn net.Conn, input *bufio.Scanner) bool {
+	word := challengeWords[rand.IntN(len(challengeWords))]
+	user.MessageChannel <- "type the word to continue: " + word
+
+	conn.SetReadDeadline(time.Now().Add(*challengeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	if !input.Scan() {
+		return false
+	}
+	line, ok := verifyLine(input.Text())
+	return ok && strings.EqualFold(strings.TrimSpace(line), word)
+}
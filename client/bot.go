@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// matchRule 是一条自动回复规则：收到的消息匹配 pattern 时发送 reply
+type matchRule struct {
+	pattern *regexp.Regexp
+	reply   string
+}
+
+// matchRules 实现了 flag.Value，-send-on-match 可以重复指定，格式为 正则=>回复
+type matchRules []matchRule
+
+func (m *matchRules) String() string {
+	parts := make([]string, 0, len(*m))
+	for _, rule := range *m {
+		parts = append(parts, rule.pattern.String()+"=>"+rule.reply)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (m *matchRules) Set(value string) error {
+	pattern, reply, ok := strings.Cut(value, "=>")
+	if !ok || reply == "" {
+		return errors.New("expected <regex>=><reply>")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	*m = append(*m, matchRule{pattern: re, reply: reply})
+	return nil
+}
+
+// respond 对收到的一行消息执行自动回复，每条匹配的规则回复一次
+// 注意回复内容本身不要匹配规则，否则机器人会和自己的消息形成循环
+func (m matchRules) respond(w io.Writer, signer lineSigner, line string) error {
+	for _, rule := range m {
+		if rule.pattern.MatchString(line) {
+			if _, err := io.WriteString(w, signer.sign(rule.reply)+"\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,41 +1,168 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 )
 
+// ansiPattern 匹配服务端附加在消息中的 ANSI 颜色转义序列
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
 func main() {
+	color := flag.Bool("color", false, "渲染服务端发来的颜色（如昵称颜色），否则去掉颜色转义序列")
+	bot := flag.Bool("bot", false, "机器人模式：从 -bot-input 读取要发送的命令和消息，把收到的消息记录到 -bot-log")
+	botInput := flag.String("bot-input", "", "机器人模式下读取命令和消息的文件或命名管道，为空时使用标准输入")
+	botLog := flag.String("bot-log", "", "机器人模式下记录收到消息的文件（追加写入），为空时输出到标准输出")
+	var rules matchRules
+	flag.Var(&rules, "send-on-match", "自动回复规则，格式为 <正则>=><回复>，可重复指定")
+	hmacKey := flag.String("hmac-key", "", "与服务端共享的消息签名密钥，设置后给发出的消息签名，并标出签名不正确的消息")
+	connectRetries := flag.Int("connect-retries", 0, "首次连接失败时的最大重试次数，重试间隔逐渐增加并带有随机抖动")
+	connectTimeout := flag.Duration("connect-timeout", 5*time.Second, "每次连接的超时时间")
+	numbered := flag.Bool("numbered", false, "给收到的每一行加上本地递增的行号，便于回看时引用；行号和服务端的消息序号无关")
+	rawLogFile := flag.String("rawlog", "", "把从服务端收到的原始内容原样追加写入该文件，便于调试，显示不受影响")
+	rawLogSent := flag.Bool("rawlog-sent", false, "同时把发给服务端的原始内容写入 -rawlog 文件，和收到的内容按时间先后混在一起")
+	flag.Parse()
+
+	signer := lineSigner{key: []byte(*hmacKey)}
+
+	input := io.Reader(os.Stdin)
+	output := io.Writer(os.Stdout)
+	if *bot {
+		if *botInput != "" {
+			f, err := os.Open(*botInput)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			input = f
+		}
+		if *botLog != "" {
+			f, err := os.OpenFile(*botLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			output = f
+		}
+	}
+
 	// 建立上面服务端启动好的 IP 和端口连接
 	// net.Dial 是一个用于建立网络连接的函数。
 	// "tcp" 是网络参数，指定要建立的连接是基于 TCP 协议的。
 	// "127.0.0.1:2020" 是地址参数，表示要连接的目标主机和端口。127.0.0.1: 表示本地主机，而 2020 是目标端口号。
-	conn, err := net.Dial("tcp", "127.0.0.1:2020")
+	// 服务端可能还没启动好，指定了 -connect-retries 时会重试几次再放弃，见 dialWithRetry
+	conn, err := dialWithRetry("127.0.0.1:2020", *connectRetries, *connectTimeout)
 	if err != nil {
 		panic(err)
 	}
 
+	// 指定了 -rawlog 时，读写都经过 rawLog 旁路一份，打不开文件时只提示，不影响聊天
+	reader, writer := io.Reader(conn), io.Writer(conn)
+	if *rawLogFile != "" {
+		f, err := os.OpenFile(*rawLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Println("打开 -rawlog 文件失败，不记录原始内容：", err)
+		} else {
+			defer f.Close()
+			raw := &rawLog{w: f}
+			reader = io.TeeReader(conn, raw)
+			if *rawLogSent {
+				writer = io.MultiWriter(conn, raw)
+			}
+		}
+	}
+
+	pings := newPinger()
+
 	// 创建一个类型为 struct{} 的通道 done，用于在主 goroutine 和后台 goroutine 之间进行同步。
 	done := make(chan struct{})
 
-	// 启动一个后台 goroutine，该 goroutine 使用 io.Copy 将 conn（一个网络连接）的内容复制到标准输出（os.Stdout）。
-	// 注意，这里忽略了错误处理。在复制完成后，输出 "done" 到日志中，并通过 done 通道发送一个空结构体的值，以向主 goroutine 发送一个信号。
+	// 启动一个后台 goroutine，该 goroutine 逐行读取 conn（一个网络连接）的内容并输出到标准输出（os.Stdout），机器人模式下输出到日志文件。
+	// 没有指定 -color 时，去掉其中的颜色转义序列，避免在不支持颜色的终端上显示乱码。
+	// 指定了 -numbered 时，在显示的每一行前面加上行号，自动回复规则匹配的仍然是不带行号的内容。
+	// 读取结束后区分服务端正常关闭和网络错误，分别给出提示，然后通过 done 通道发送一个空结构体的值，以向主 goroutine 发送一个信号。
 	go func() {
-		io.Copy(os.Stdout, conn) // NOTE: ignoring errors
-		log.Println("done")
+		scanner := bufio.NewScanner(reader)
+		lineNo := 0
+		for scanner.Scan() {
+			line, ok := signer.verify(scanner.Text())
+			if !ok {
+				line = "[corrupted] " + line
+			}
+			if !*color {
+				line = ansiPattern.ReplaceAllString(line, "")
+			}
+			if rtt, ok := pings.finish(line); ok {
+				line = rtt
+			}
+			if *numbered {
+				lineNo++
+				fmt.Fprintf(output, "%4d  %s\n", lineNo, line)
+			} else {
+				fmt.Fprintln(output, line)
+			}
+			if err := rules.respond(writer, signer, line); err != nil {
+				log.Println("自动回复失败：", err)
+			}
+		}
+		switch err := scanner.Err(); {
+		case err == nil:
+			log.Println("disconnected by server")
+		case errors.Is(err, net.ErrClosed):
+			// 本地输入结束后主动关闭了连接，属于正常退出
+		default:
+			log.Println("connection error:", err)
+		}
 		done <- struct{}{} // signal the main goroutine
 	}()
 
-	// 调用函数 mustCopy，将标准输入（os.Stdin）的内容复制到 conn（网络连接）中。
-	mustCopy(conn, os.Stdin)
-	conn.Close()
+	// 在后台调用函数 sendLines，将标准输入（os.Stdin）或机器人的输入文件的内容逐行发送到 conn（网络连接）中。
+	// 输入结束（EOF）是正常情况，此时关闭连接；机器人模式下输入读完后不断开，继续接收消息并自动回复，直到服务端关闭连接。
+	// 服务端先断开时，主 goroutine 收到 done 信号后直接退出，不必等待输入结束。
+	go func() {
+		if err := sendLines(writer, input, pings, signer); err != nil {
+			log.Println("send failed:", err)
+			conn.Close()
+			return
+		}
+		if !*bot {
+			conn.Close()
+		}
+	}()
 	<-done
 }
 
-func mustCopy(dst io.Writer, src io.Reader) {
-	if _, err := io.Copy(dst, src); err != nil {
-		log.Fatal(err)
+// sendLines 逐行读取输入并签名后发送给服务端，/clear 等本地命令不发送（见 handleLocal），
+// /ping 会被替换成带 nonce 的命令，以便收到 pong 时计算往返时间，/sendfile 改为发送文件的内容（见 sendFile）
+// 输入正常结束时返回 nil，读取输入或写入连接出错时返回对应的错误
+func sendLines(dst io.Writer, src io.Reader, pings *pinger, signer lineSigner) error {
+	input := bufio.NewScanner(src)
+	for input.Scan() {
+		line := input.Text()
+		if handleLocal(line) {
+			continue
+		}
+		if line == "/sendfile" || strings.HasPrefix(line, "/sendfile ") {
+			if err := sendFile(dst, strings.TrimSpace(strings.TrimPrefix(line, "/sendfile")), signer); err != nil {
+				return err
+			}
+			continue
+		}
+		if line == "/ping" {
+			line = pings.start()
+		}
+		if _, err := io.WriteString(dst, signer.sign(line)+"\n"); err != nil {
+			return err
+		}
 	}
+	return input.Err()
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// 重试之间的等待时间从 retryBase 开始每次翻倍，最多 retryMax，再加上最多一半的随机抖动，避免多个客户端同时重试
+const (
+	retryBase = 200 * time.Millisecond
+	retryMax  = 5 * time.Second
+)
+
+// dialWithRetry 连接服务端，失败时最多重试 retries 次，用于服务端和客户端同时启动、服务端还没开始监听的情况
+// timeout 是每次连接的超时时间，0 表示使用系统默认值
+func dialWithRetry(addr string, retries int, timeout time.Duration) (net.Conn, error) {
+	wait := retryBase
+	for attempt := 0; ; attempt++ {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err == nil || attempt >= retries {
+			return conn, err
+		}
+
+		delay := wait + rand.N(wait/2+1)
+		log.Printf("连接 %s 失败（%v），%s 后重试（%d/%d）", addr, err, delay.Round(time.Millisecond), attempt+1, retries)
+		time.Sleep(delay)
+		wait = min(wait*2, retryMax)
+	}
+}
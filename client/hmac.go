@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// lineSigner 使用和服务端共享的密钥给发出的每行消息签名，并校验收到的消息，key 为空时不做处理
+type lineSigner struct {
+	key []byte
+}
+
+// sign 在一行文本后面附上以制表符分隔的 HMAC-SHA256 签名
+func (s lineSigner) sign(line string) string {
+	if len(s.key) == 0 {
+		return line
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(line))
+	return line + "\t" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify 校验并去掉一行文本末尾的签名，签名不正确时返回 false
+func (s lineSigner) verify(line string) (string, bool) {
+	if len(s.key) == 0 {
+		return line, true
+	}
+	i := strings.LastIndexByte(line, '\t')
+	if i < 0 {
+		return line, false
+	}
+	sum, err := hex.DecodeString(line[i+1:])
+	if err != nil {
+		return line, false
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(line[:i]))
+	return line[:i], hmac.Equal(sum, mac.Sum(nil))
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// ansiClear 把光标移到左上角并清屏
+const ansiClear = "\033[H\033[2J"
+
+// handleLocal 处理只在客户端执行、不发给服务端的命令，已处理时返回 true
+func handleLocal(line string) bool {
+	switch line {
+	case "/clear":
+		// 输出被重定向到文件或管道时，清屏序列只会变成乱码，因此什么也不做
+		if isTerminal(os.Stdout) {
+			fmt.Fprint(os.Stdout, ansiClear)
+		}
+		return true
+	}
+	return false
+}
+
+// isTerminal 判断文件是否是终端（字符设备），不依赖第三方库
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
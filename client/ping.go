@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pinger 记录已发出但还没收到 pong 的 /ping，用于计算往返时间
+// 发送和接收在不同的 goroutine 中，因此需要加锁
+type pinger struct {
+	mu      sync.Mutex
+	next    int
+	pending map[string]time.Time
+}
+
+func newPinger() *pinger {
+	return &pinger{pending: make(map[string]time.Time)}
+}
+
+// start 生成一个新的 nonce 并记录发送时间，返回要发给服务端的命令
+func (p *pinger) start() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.next++
+	nonce := strconv.Itoa(p.next)
+	p.pending[nonce] = time.Now()
+	return "/ping " + nonce
+}
+
+// finish 识别服务端回复的 "pong <nonce> ..."，是自己发出的 ping 时返回展示用的往返时间
+func (p *pinger) finish(line string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "pong" {
+		return "", false
+	}
+
+	p.mu.Lock()
+	sentAt, ok := p.pending[fields[1]]
+	delete(p.pending, fields[1])
+	p.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("pong: round-trip %s", time.Since(sentAt).Round(time.Microsecond)), true
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+)
+
+// rawLog 把连接上收发的原始字节原样写入 -rawlog 文件，用于开发机器人和排查显示被颜色、控制字符弄乱的问题
+// 读写两个 goroutine 会同时写入，因此加锁；写文件出错时只记录一次并停止记录，不影响聊天本身
+type rawLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	failed bool
+}
+
+// Write 总是报告写入成功，这样 io.TeeReader 和 io.MultiWriter 不会因为日志文件出错而中断连接
+func (r *rawLog) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed {
+		return len(p), nil
+	}
+	if _, err := r.w.Write(p); err != nil {
+		r.failed = true
+		log.Println("写入 -rawlog 文件失败，停止记录：", err)
+	}
+	return len(p), nil
+}
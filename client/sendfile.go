@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// /sendfile 发送的文件大小和行数上限；服务端按行处理消息，每一行都是一条消息，
+// 行数太多会触发服务端的频率限制（-rate-limit）被丢弃，因此只适合分享小段配置或日志
+const (
+	maxSendFileSize  = 4096
+	maxSendFileLines = 20
+)
+
+// readSendFile 读取要发送的文件并拆成行，空行不发送；文件不存在、太大或不是文本时返回错误
+func readSendFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// 多读一个字节，用来判断文件是否超过上限
+	data, err := io.ReadAll(io.LimitReader(f, maxSendFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSendFileSize {
+		return nil, errors.New("file is too large, max " + strconv.Itoa(maxSendFileSize) + " bytes")
+	}
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return nil, errors.New("not a text file")
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("file is empty")
+	}
+	if len(lines) > maxSendFileLines {
+		return nil, errors.New("file has too many lines, max " + strconv.Itoa(maxSendFileLines))
+	}
+	return lines, nil
+}
+
+// sendFile 处理 /sendfile <path>，把文件逐行签名后发给服务端
+// 文件内容都是普通消息，以 / 开头的行加上一个 / 转义，服务端去掉后原样广播，不会当作命令执行
+// 读取文件的错误只在本地提示，不影响连接；只有写入连接出错时才返回错误
+func sendFile(dst io.Writer, path string, signer lineSigner) error {
+	if path == "" {
+		log.Println("usage: /sendfile <path>")
+		return nil
+	}
+	lines, err := readSendFile(path)
+	if err != nil {
+		log.Println("/sendfile:", err)
+		return nil
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "/") {
+			line = "/" + line
+		}
+		if _, err := io.WriteString(dst, signer.sign(line)+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
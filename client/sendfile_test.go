@@ -0,0 +1,18 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// 文件中以 / 开头的行要转义后发送，不能被服务端当作命令执行
+func TestSendFileEscapesCommands(t *testing.T) {
+	var out strings.Builder
+	if err := sendFile(&out, "testdata/sendfile.txt", lineSigner{}); err != nil {
+		t.Fatal(err)
+	}
+	want := "first line\n//quit\n///already escaped\n"
+	if out.String() != want {
+		t.Fatalf("sendFile wrote %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// command 描述一条以 / 开头的聊天室命令
+type command struct {
+	name      string                        // name 是命令名，不含前缀 /；
+	usage     string                        // usage 是命令的用法说明；
+	desc      string                        // desc 是命令的简短描述；
+	adminOnly bool                          // adminOnly 表示仅管理员可用，权限由 handler 在 broadcaster 中检查；
+	aliases   []string                      // aliases 是命令的别名，不含前缀 /，如 join 的 j；
+	handler   func(user *User, args string) // handler 在用户所在的 handleConn goroutine 中执行；
+}
+
+// commands 保存所有已注册的命令，aliases 保存别名到命令名的映射
+// 它们只在 init 阶段和 main 开始接受连接之前（外部命令、-alias）写入，之后只读，因此无需加锁
+var (
+	commands = make(map[string]*command)
+	aliases  = make(map[string]string)
+)
+
+func registerCommand(c *command) {
+	commands[c.name] = c
+	for _, alias := range c.aliases {
+		aliases[alias] = c.name
+	}
+}
+
+// registerAlias 给已注册的命令添加别名，别名不能和已有的命令或别名重名
+func registerAlias(alias, name string) error {
+	c, ok := commands[name]
+	if !ok {
+		return errors.New("alias /" + alias + " refers to unknown command /" + name)
+	}
+	if _, ok := commands[alias]; ok {
+		return errors.New("alias /" + alias + " conflicts with an existing command")
+	}
+	if _, ok := aliases[alias]; ok {
+		return errors.New("alias /" + alias + " is already defined")
+	}
+	c.aliases = append(c.aliases, alias)
+	aliases[alias] = name
+	return nil
+}
+
+// aliasList 实现了 flag.Value，格式为 <alias>=<command>，可重复指定，在 setup 中注册
+type aliasList [][2]string
+
+func (a *aliasList) String() string {
+	parts := make([]string, len(*a))
+	for i, pair := range *a {
+		parts[i] = pair[0] + "=" + pair[1]
+	}
+	return strings.Join(parts, ",")
+}
+
+func (a *aliasList) Set(value string) error {
+	alias, name, ok := strings.Cut(value, "=")
+	alias, name = strings.TrimPrefix(alias, "/"), strings.TrimPrefix(name, "/")
+	if !ok || alias == "" || name == "" || strings.Contains(alias, " ") {
+		return errors.New("expected <alias>=<command>")
+	}
+	*a = append(*a, [2]string{alias, name})
+	return nil
+}
+
+var customAliases aliasList
+
+func init() {
+	flag.Var(&customAliases, "alias", "自定义命令别名，格式为 <别名>=<命令>，如 w=whois，可重复指定")
+}
+
+// registerCustomAliases 注册 -alias 指定的别名，需要在外部命令注册之后调用，以便给外部命令起别名
+func registerCustomAliases() error {
+	for _, pair := range customAliases {
+		if err := registerAlias(pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commandInfo 是命令目录中的一项，由注册表生成，供 /help 和 /export commands 使用
+type commandInfo struct {
+	Name      string   `json:"name"`
+	Usage     string   `json:"usage"`
+	Desc      string   `json:"desc"`
+	AdminOnly bool     `json:"admin_only"`
+	Aliases   []string `json:"aliases,omitempty"`
+}
+
+// commandCatalog 按命令名排序返回所有已注册的命令，新注册的命令会自动出现在目录中
+func commandCatalog() []commandInfo {
+	infos := make([]commandInfo, 0, len(commands))
+	for _, c := range commands {
+		names := slices.Clone(c.aliases)
+		slices.Sort(names)
+		infos = append(infos, commandInfo{Name: c.name, Usage: c.usage, Desc: c.desc, AdminOnly: c.adminOnly, Aliases: names})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func init() {
+	registerCommand(&command{
+		name:    "help",
+		usage:   "/help",
+		desc:    "列出所有命令及其用法",
+		handler: cmdHelp,
+	})
+	registerCommand(&command{
+		name:    "mystats",
+		usage:   "/mystats",
+		desc:    "查看自己的消息收发统计",
+		handler: cmdMyStats,
+	})
+	registerCommand(&command{
+		name:    "list",
+		usage:   "/list",
+		desc:    "列出所有在线用户",
+		handler: cmdList,
+	})
+	registerCommand(&command{
+		name:    "ping",
+		usage:   "/ping [nonce]",
+		desc:    "测试与服务端的连通性，服务端原样带回 nonce",
+		handler: cmdPing,
+	})
+	registerCommand(&command{
+		name:    "echo",
+		usage:   "/echo <text>",
+		desc:    "原样回复 text，用于确认命令和连接都正常",
+		handler: cmdEcho,
+	})
+	registerCommand(&command{
+		name:    "uptime",
+		usage:   "/uptime",
+		desc:    "查看服务已运行的时间",
+		handler: cmdUptime,
+	})
+	registerCommand(&command{
+		name:    "whois",
+		usage:   "/whois <id|nick>",
+		desc:    "查看用户的信息",
+		handler: cmdWhois,
+	})
+}
+
+// errorJSON 是 json 格式下命令失败的回复
+type errorJSON struct {
+	Kind    string `json:"kind"`              // 总是 error
+	Command string `json:"command,omitempty"` // 不是命令引起的错误（如无法解析的 json 输入）时为空
+	Reason  string `json:"reason"`
+}
+
+// formatError 按用户选择的格式生成命令失败的回复：文本格式为 "! error: <reason>"，
+// json 格式为 {"kind":"error","command":...,"reason":...}，机器人据此区分失败和正常回复，只能在 broadcaster 中调用
+func formatError(user *User, command, reason string) string {
+	if user.format != formatJSON {
+		return "! error: " + reason
+	}
+	data, err := json.Marshal(errorJSON{Kind: "error", Command: command, Reason: stripANSI(reason)})
+	if err != nil {
+		// errorJSON 中只有字符串，实际不会编码失败；万一失败时退回文本格式
+		return "! error: " + reason
+	}
+	return string(data)
+}
+
+// fail 回复命令失败（参数错误、权限不足、目标不存在等），所有命令的失败都经由这里，只能在 broadcaster 中调用
+// command 是命令名，不含前缀 /
+func (s *chatState) fail(user *User, command, reason string) {
+	s.send(user, formatError(user, command, reason))
+}
+
+// replyError 在 handleConn 中回复命令失败；用户选择的格式只能在 broadcaster 中读取，因此交给 broadcaster 回复
+func replyError(user *User, command, reason string) {
+	actionChannel <- func(s *chatState) {
+		s.fail(user, command, reason)
+	}
+}
+
+// handleCommand 解析形如 "/name args" 的输入，并分发给对应的命令处理函数
+func handleCommand(user *User, line string) {
+	name, args, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	dispatchCommand(user, name, args)
+}
+
+// dispatchCommand 按命令名（可以是别名）调用命令处理函数，文本输入和 json 输入共用
+func dispatchCommand(user *User, name, args string) {
+	if target, ok := aliases[name]; ok {
+		name = target
+	}
+	c, ok := commands[name]
+	if !ok {
+		replyError(user, name, "unknown command: /"+name)
+		return
+	}
+	c.handler(user, strings.TrimSpace(args))
+}
+
+// cmdHelp 根据命令目录生成帮助，一次性发送多行回复，仅管理员可用的命令会标注出来
+func cmdHelp(user *User, _ string) {
+	catalog := commandCatalog()
+	lines := make([]string, 0, len(catalog)+1)
+	lines = append(lines, "available commands:")
+	for _, c := range catalog {
+		line := c.Usage + " - " + c.Desc
+		if len(c.Aliases) > 0 {
+			line += " (alias: /" + strings.Join(c.Aliases, ", /") + ")"
+		}
+		if c.AdminOnly {
+			line += " (admin)"
+		}
+		lines = append(lines, line)
+	}
+	user.MessageChannel <- strings.Join(lines, "\n")
+}
+
+// cmdMyStats 私下回复用户自己的消息收发情况，被丢弃的消息数可以反映连接是否健康
+func cmdMyStats(user *User, _ string) {
+	user.MessageChannel <- fmt.Sprintf("sent: %d, received: %d, dropped: %d, bytes in: %d, bytes out: %d, online: %s",
+		user.sentCount.Load(),
+		user.receivedCount.Load(),
+		user.droppedCount.Load(),
+		user.bytesIn.Load(),
+		user.bytesOut.Load(),
+		time.Since(user.EnterAt).Round(time.Second),
+	)
+}
+
+// cmdList 按 ID 顺序列出所有在线用户及其所在房间
+func cmdList(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		users := make([]*User, 0, len(s.users))
+		for u := range s.users {
+			users = append(users, u)
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+		lines := make([]string, 0, len(users))
+		for _, u := range users {
+			line := strconv.Itoa(u.ID)
+			if u.Nick != "" {
+				line += " " + u.Nick
+			}
+			line += " (" + u.Room + ")"
+			if u.status != "" {
+				line += " - " + u.status
+			}
+			lines = append(lines, line)
+		}
+		s.send(user, strconv.Itoa(len(users))+" users online: "+strings.Join(lines, ", "))
+	}
+}
+
+// cmdEcho 是最简单的命令：直接在 handleConn 中把参数写回调用者的 MessageChannel，不经过 broadcaster
+func cmdEcho(user *User, args string) {
+	if args == "" {
+		replyError(user, "echo", "usage: /echo <text>")
+		return
+	}
+	user.MessageChannel <- args
+}
+
+// cmdPing 经由 broadcaster 回复 pong，带回客户端的 nonce 以及服务端处理耗时，客户端据此计算往返时间
+func cmdPing(user *User, args string) {
+	start := time.Now()
+	actionChannel <- func(s *chatState) {
+		s.send(user, strings.TrimSpace("pong "+args)+" (server "+time.Since(start).String()+")")
+	}
+}
+
+func cmdUptime(user *User, _ string) {
+	user.MessageChannel <- "server uptime: " + time.Since(startTime).Round(time.Second).String()
+}
+
+// cmdWhois 查询用户的公开信息，IP 地址只对管理员展示
+func cmdWhois(user *User, args string) {
+	if args == "" {
+		replyError(user, "whois", "usage: /whois <id|nick>")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		target := s.lookupUser(args)
+		if target == nil {
+			s.fail(user, "whois", "no such user: "+args)
+			return
+		}
+
+		info := "user " + strconv.Itoa(target.ID) + ": nick " + target.displayName() +
+			", room " + target.Room +
+			", online " + time.Since(target.EnterAt).Round(time.Second).String()
+		if s.isAdmin(target) {
+			info += ", admin"
+		}
+		if target.status != "" {
+			info += ", status " + strconv.Quote(target.status)
+		}
+		if s.isAdmin(user) {
+			info += ", addr " + target.Addr
+		}
+		s.send(user, info)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+)
+
+// secretFlags 是 /config 中不显示取值的参数
+var secretFlags = map[string]bool{
+	"admin-pass": true,
+	"hmac-key":   true,
+}
+
+func init() {
+	registerCommand(&command{
+		name:      "config",
+		usage:     "/config",
+		desc:      "查看服务端实际生效的启动参数，口令和密钥只显示是否设置",
+		adminOnly: true,
+		handler:   cmdConfig,
+	})
+}
+
+// configReport 按参数名列出所有启动参数的当前取值，显式指定过的参数标注出来
+func configReport() string {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	lines := []string{"server configuration:"}
+	flag.VisitAll(func(f *flag.Flag) {
+		value := strconv.Quote(f.Value.String())
+		if secretFlags[f.Name] {
+			value = "(not set)"
+			if f.Value.String() != "" {
+				value = "(redacted)"
+			}
+		}
+		line := "  -" + f.Name + " = " + value
+		if set[f.Name] {
+			line += " [set]"
+		}
+		lines = append(lines, line)
+	})
+	return strings.Join(lines, "\n")
+}
+
+// cmdConfig 只需要读取参数，但仍然经由 broadcaster 检查管理员身份
+func cmdConfig(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "config") {
+			return
+		}
+		s.send(user, configReport())
+	}
+}
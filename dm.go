@@ -0,0 +1,210 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	inboxSize = flag.Int("offline-inbox", 0, "给刚断开的用户的昵称发私信时，为每个昵称最多暂存的消息数，原用户从同一 IP 取回昵称时收到，0 表示不暂存")
+	inboxTTL  = flag.Duration("offline-inbox-ttl", 24*time.Hour, "暂存私信的保留时长，过期后丢弃")
+)
+
+const (
+	// 最多为多少个昵称暂存私信，避免给大量不存在的昵称发私信占满内存
+	maxInboxes = 1000
+	// /msgmany 一次最多的收件人数
+	maxRecipients = 10
+)
+
+// inboxMessage 是一条暂存的私信
+type inboxMessage struct {
+	from string // from 是发送者发送时的昵称或 ID；
+	host string // host 是收件人离开前的 IP，只有来自这个 IP 的用户能收到，见 inboxOwner；
+	text string
+	at   time.Time
+}
+
+// inboxOwner 记录带昵称离开的用户来自哪个 IP
+// 昵称没有注册机制，之后随便哪个用户都能拿到这个昵称，暂存的私信只送给从原 IP 回来的用户
+type inboxOwner struct {
+	host string
+	at   time.Time // at 是离开的时间，超过 -offline-inbox-ttl 后不再为这个昵称暂存私信；
+}
+
+func init() {
+	registerCommand(&command{
+		name:    "msg",
+		usage:   "/msg <nick|id> <text>",
+		desc:    "给用户发私信；开启 -offline-inbox 时，刚断开的用户的私信会暂存，等对方重连后送达",
+		handler: cmdMsg,
+	})
+	registerCommand(&command{
+		name:    "msgmany",
+		usage:   "/msgmany <id|nick>,<id|nick>,... <text>",
+		desc:    "给多个在线用户发同一条私信，最多 " + strconv.Itoa(maxRecipients) + " 人",
+		handler: cmdMsgMany,
+	})
+}
+
+func cmdMsg(user *User, args string) {
+	target, text, _ := strings.Cut(args, " ")
+	text = normalizeSpace(strings.TrimSpace(text))
+	if target == "" || text == "" {
+		replyError(user, "msg", "usage: /msg <nick|id> <text>")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		if to := s.lookupUser(target); to != nil {
+			s.send(to, "[dm from "+user.displayName()+"] "+text)
+			s.send(user, "[dm to "+to.displayName()+"] "+text)
+			return
+		}
+		s.queueDM(user, target, text)
+	}
+}
+
+// remoteHost 从 "IP:端口" 形式的地址中取出 IP，取不出时原样返回
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// recordInboxOwner 在带昵称的用户离开时记下其 IP，之后发给这个昵称的私信才会暂存，只能在 broadcaster 中调用
+func (s *chatState) recordInboxOwner(user *User, now time.Time) {
+	if *inboxSize <= 0 || user.Nick == "" {
+		return
+	}
+	key := strings.ToLower(user.Nick)
+	if _, ok := s.inboxOwners[key]; !ok && len(s.inboxOwners) >= maxInboxes {
+		return
+	}
+	s.inboxOwners[key] = inboxOwner{host: remoteHost(user.Addr), at: now}
+}
+
+// cmdMsgMany 把同一条私信发给多个在线用户，重复的收件人只发一次，不在线的收件人不会暂存
+func cmdMsgMany(user *User, args string) {
+	list, text, _ := strings.Cut(args, " ")
+	text = normalizeSpace(strings.TrimSpace(text))
+	var targets []string
+	seen := make(map[string]bool)
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" && !seen[strings.ToLower(t)] {
+			seen[strings.ToLower(t)] = true
+			targets = append(targets, t)
+		}
+	}
+	if len(targets) == 0 || text == "" {
+		replyError(user, "msgmany", "usage: /msgmany <id|nick>,<id|nick>,... <text>")
+		return
+	}
+	if len(targets) > maxRecipients {
+		replyError(user, "msgmany", "too many recipients, max "+strconv.Itoa(maxRecipients))
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		var sent, offline []string
+		delivered := make(map[*User]bool)
+		for _, t := range targets {
+			to := s.lookupUser(t)
+			if to == nil {
+				offline = append(offline, t)
+				continue
+			}
+			// 同一个用户可能既按 ID 又按昵称出现
+			if delivered[to] {
+				continue
+			}
+			delivered[to] = true
+			s.send(to, "[dm from "+user.displayName()+"] "+text)
+			sent = append(sent, to.displayName())
+		}
+
+		reply := "[dm to " + strings.Join(sent, ", ") + "] " + text
+		if len(sent) == 0 {
+			reply = "nobody received the message"
+		}
+		if len(offline) > 0 {
+			reply += "\nnot online: " + strings.Join(offline, ", ")
+		}
+		s.send(user, reply)
+	}
+}
+
+// queueDM 把发给不在线昵称的私信放进该昵称的收件箱，只能在 broadcaster 中调用
+// 只为 -offline-inbox-ttl 内带着这个昵称离开的用户暂存，并记下原用户的 IP，送达时核对
+func (s *chatState) queueDM(from *User, nick string, text string) {
+	key := strings.ToLower(nick)
+	owner, ok := s.inboxOwners[key]
+	if *inboxSize <= 0 || !ok {
+		s.fail(from, "msg", "no such user: "+nick)
+		return
+	}
+	inbox, ok := s.inboxes[key]
+	if !ok && len(s.inboxes) >= maxInboxes {
+		s.fail(from, "msg", "too many offline messages on the server, try again later")
+		return
+	}
+	if len(inbox) >= *inboxSize {
+		s.fail(from, "msg", "the inbox of "+nick+" is full")
+		return
+	}
+	s.inboxes[key] = append(inbox, inboxMessage{from: from.displayName(), host: owner.host, text: text, at: time.Now()})
+	s.send(from, nick+" is offline, the message will be delivered when they reconnect")
+}
+
+// deliverInbox 在用户设置昵称后，把该昵称收件箱中发给同一 IP 的私信合并成一条多行消息发给用户，只能在 broadcaster 中调用
+// 来自其他 IP 的用户拿到这个昵称时什么也收不到，私信继续留给原用户，直到过期
+func (s *chatState) deliverInbox(user *User) {
+	key := strings.ToLower(user.Nick)
+	host := remoteHost(user.Addr)
+	var inbox, rest []inboxMessage
+	for _, m := range s.inboxes[key] {
+		if m.host == host {
+			inbox = append(inbox, m)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+	if len(inbox) == 0 {
+		return
+	}
+	if len(rest) == 0 {
+		delete(s.inboxes, key)
+	} else {
+		s.inboxes[key] = rest
+	}
+
+	lines := []string{"you have " + strconv.Itoa(len(inbox)) + " messages while you were away:"}
+	for _, m := range inbox {
+		lines = append(lines, "  ["+m.at.Format(time.DateTime)+"] [dm from "+m.from+"] "+m.text)
+	}
+	s.send(user, strings.Join(lines, "\n"))
+}
+
+// pruneInboxes 丢弃超过 -offline-inbox-ttl 的暂存私信和离开记录
+func (s *chatState) pruneInboxes(now time.Time) {
+	for key, owner := range s.inboxOwners {
+		if now.Sub(owner.at) >= *inboxTTL {
+			delete(s.inboxOwners, key)
+		}
+	}
+	for key, inbox := range s.inboxes {
+		i := 0
+		for i < len(inbox) && now.Sub(inbox[i].at) >= *inboxTTL {
+			i++
+		}
+		if i == len(inbox) {
+			delete(s.inboxes, key)
+		} else if i > 0 {
+			s.inboxes[key] = inbox[i:]
+		}
+	}
+}
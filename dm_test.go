@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 暂存的私信只送给从原 IP 取回昵称的用户，别人用同一个昵称收不到
+func TestInboxOwnership(t *testing.T) {
+	// broadcaster 在用户离开时也会读取 -offline-inbox，要在 broadcaster 中修改
+	var sizeBefore int
+	inBroadcaster(func(*chatState) {
+		sizeBefore = *inboxSize
+		*inboxSize = 5
+	})
+	defer inBroadcaster(func(*chatState) { *inboxSize = sizeBefore })
+
+	newUser := func(id int, addr string) *User {
+		return &User{ID: id, Addr: addr, MessageChannel: make(chan string, 8), priorityChannel: make(chan string, 4)}
+	}
+	s := newChatState()
+	defer s.close()
+	sender := newUser(1, "10.0.0.9:5000")
+	s.users[sender] = struct{}{}
+
+	// 没有人带着这个昵称离开过，不暂存
+	s.queueDM(sender, "bob", "hello")
+	if got := <-sender.MessageChannel; !strings.Contains(got, "no such user") {
+		t.Fatalf("queueDM to unknown nick replied %q", got)
+	}
+
+	bob := newUser(2, "10.0.0.1:4000")
+	bob.Nick = "bob"
+	s.recordInboxOwner(bob, time.Now())
+	s.queueDM(sender, "Bob", "hello")
+	if got := <-sender.MessageChannel; !strings.Contains(got, "offline") {
+		t.Fatalf("queueDM to departed nick replied %q", got)
+	}
+
+	impostor := newUser(3, "10.0.0.2:4000")
+	impostor.Nick = "bob"
+	s.deliverInbox(impostor)
+	if len(impostor.MessageChannel) != 0 {
+		t.Fatalf("impostor received %q", <-impostor.MessageChannel)
+	}
+
+	back := newUser(4, "10.0.0.1:4001")
+	back.Nick = "bob"
+	s.deliverInbox(back)
+	if len(back.MessageChannel) == 0 {
+		t.Fatal("owner received nothing")
+	}
+	if got := <-back.MessageChannel; !strings.Contains(got, "[dm from 1] hello") {
+		t.Fatalf("owner received %q", got)
+	}
+	if len(s.inboxes) != 0 {
+		t.Fatalf("inbox not cleared: %v", s.inboxes)
+	}
+}
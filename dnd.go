@@ -0,0 +1,35 @@
+package main
+
+func init() {
+	registerCommand(&command{
+		name:    "dnd",
+		usage:   "/dnd [on|off]",
+		desc:    "免打扰模式：只接收提及自己的消息和发给自己的回复",
+		handler: cmdDND,
+	})
+}
+
+// cmdDND 开启或关闭免打扰模式，不带参数时切换
+// 免打扰时不再接收房间里的广播，但提及自己（见 mentionedUsers）的消息、自己发出的消息以及命令回复等私下发送的消息照常送达
+func cmdDND(user *User, args string) {
+	if args != "" && args != "on" && args != "off" {
+		replyError(user, "dnd", "usage: /dnd [on|off]")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		switch args {
+		case "on":
+			user.dnd = true
+		case "off":
+			user.dnd = false
+		default:
+			user.dnd = !user.dnd
+		}
+		if user.dnd {
+			s.send(user, "do not disturb is on, you will only receive messages that mention you")
+		} else {
+			s.send(user, "do not disturb is off")
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+func init() {
+	registerCommand(&command{
+		name:    "echo-self",
+		usage:   "/echo-self [on|off]",
+		desc:    "是否接收自己发出的消息的回显，默认开启",
+		handler: cmdEchoSelf,
+	})
+}
+
+// cmdEchoSelf 开启或关闭自己消息的回显，不带参数时切换
+// 默认开启，发送者和其他人一样按广播的先后收到自己的消息，可以据此确认消息已送达；
+// 关闭后只是不再收到自己的普通消息，自己消息的编辑、删除、表情回应等提醒照常送达
+func cmdEchoSelf(user *User, args string) {
+	if args != "" && args != "on" && args != "off" {
+		replyError(user, "echo-self", "usage: /echo-self [on|off]")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		switch args {
+		case "on":
+			user.noEcho = false
+		case "off":
+			user.noEcho = true
+		default:
+			user.noEcho = !user.noEcho
+		}
+		if user.noEcho {
+			s.send(user, "echo of your own messages is off")
+		} else {
+			s.send(user, "echo of your own messages is on")
+		}
+	}
+}
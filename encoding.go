@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// 有些原始客户端会发来非法的 UTF-8，原样转发可能弄乱其他用户的终端
+	invalidUTF8 = flag.String("invalid-utf8", "replace", "收到非法 UTF-8 时的处理方式：replace 替换成 U+FFFD，reject 丢弃该行并提醒发送者，allow 原样转发")
+	// 大量的空格和制表符可以把内容挤出屏幕或伪造对齐
+	collapseSpace = flag.Bool("collapse-whitespace", false, "广播前把消息中连续的空白（空格、制表符等）合并成一个空格，并去掉首尾空白")
+)
+
+const (
+	utf8Replace = "replace"
+	utf8Reject  = "reject"
+	utf8Allow   = "allow"
+)
+
+// checkUTF8 按 -invalid-utf8 处理一行输入，返回处理后的内容，该行应当丢弃时返回 false
+func checkUTF8(line string) (string, bool) {
+	if utf8.ValidString(line) {
+		return line, true
+	}
+	switch *invalidUTF8 {
+	case utf8Reject:
+		return "", false
+	case utf8Replace:
+		return strings.ToValidUTF8(line, string(utf8.RuneError)), true
+	}
+	return line, true
+}
+
+// collapseWhitespace 把连续的空白合并成一个空格并去掉首尾空白，消息只有空白时返回空串
+func collapseWhitespace(line string) string {
+	return strings.Join(strings.Fields(line), " ")
+}
+
+// normalizeSpace 在开启 -collapse-whitespace 时合并消息中的空白，供 /ttl、/in、/edit 处理正文
+func normalizeSpace(text string) string {
+	if !*collapseSpace {
+		return text
+	}
+	return collapseWhitespace(text)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckUTF8(t *testing.T) {
+	defer func(mode string) { *invalidUTF8 = mode }(*invalidUTF8)
+
+	tests := []struct {
+		mode string
+		line string
+		want string
+		ok   bool
+	}{
+		{utf8Replace, "hello 中文", "hello 中文", true},
+		{utf8Replace, "bad \xff\xfe bytes", "bad � bytes", true},
+		{utf8Replace, "truncated \xe4\xb8", "truncated �", true},
+		{utf8Reject, "hello 中文", "hello 中文", true},
+		{utf8Reject, "bad \xff\xfe bytes", "", false},
+		{utf8Reject, "truncated \xe4\xb8", "", false},
+		{utf8Allow, "bad \xff\xfe bytes", "bad \xff\xfe bytes", true},
+		{utf8Allow, "truncated \xe4\xb8", "truncated \xe4\xb8", true},
+	}
+	for _, tt := range tests {
+		*invalidUTF8 = tt.mode
+		got, ok := checkUTF8(tt.line)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: checkUTF8(%q) = %q, %v, want %q, %v", tt.mode, tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCollapseWhitespace(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"single spaces", "hello there world", "hello there world"},
+		{"space heavy", "   hello" + strings.Repeat(" ", 40) + "world   ", "hello world"},
+		{"tab heavy", "\t\thello\t\t\t\tworld\t", "hello world"},
+		{"mixed", "a \t \t b\v\fc", "a b c"},
+		{"spoofed alignment", "hi" + strings.Repeat("\t", 20) + "#7 admin: fake", "hi #7 admin: fake"},
+		{"only tabs", "\t\t\t", ""},
+		{"only spaces", strings.Repeat(" ", 100), ""},
+		{"unicode spaces", "a　 b", "a b"},
+	}
+	for _, tt := range tests {
+		if got := collapseWhitespace(tt.line); got != tt.want {
+			t.Errorf("%s: collapseWhitespace(%q) = %q, want %q", tt.name, tt.line, got, tt.want)
+		}
+	}
+}
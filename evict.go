@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+// 接收过慢的用户，send 会丢弃发给他的消息而不是阻塞 broadcaster；但如果客户端彻底卡住、再也不读取，
+// 丢弃会一直持续下去。开启 -client-send-timeout 后，用户的通道从第一次投递失败起持续写满超过该时长，
+// 就认为连接已经失效：关闭连接让写 goroutine 和读循环都结束，之后由 handleConn 经 leavingChannel 注销
+// 投递本身仍然不会阻塞，超时是在之后的投递失败时判断的，因此一个卡住的用户不会拖慢其他用户
+var clientSendTimeout = flag.Duration("client-send-timeout", 0, "用户的消息通道持续写满超过该时长时断开该用户，0 表示只丢弃消息、不断开")
+
+// delivered 在成功投递给用户后调用，清除卡住的计时
+func (u *User) delivered() {
+	u.receivedCount.Add(1)
+	u.stalledSince = time.Time{}
+}
+
+// undelivered 在因通道写满丢弃消息后调用，卡住超过 -client-send-timeout 时断开用户
+// 可能在 fanout worker 中调用，只读写该用户自己的字段
+func (u *User) undelivered() {
+	u.droppedCount.Add(1)
+	if *clientSendTimeout <= 0 {
+		return
+	}
+	now := time.Now()
+	if u.stalledSince.IsZero() {
+		u.stalledSince = now
+		return
+	}
+	if now.Sub(u.stalledSince) < *clientSendTimeout || u.evicted.Swap(true) {
+		return
+	}
+	log.Printf("user %d (%s) 超过 %s 无法接收消息，断开连接", u.ID, u.Addr, *clientSendTimeout)
+	// 写 goroutine 可能正阻塞在 Write 上，只有关闭连接才能让它返回
+	u.conn.Close()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 从不读取的客户端在消息通道持续写满超过 -client-send-timeout 后被断开
+func TestEvictStalledClient(t *testing.T) {
+	var timeoutBefore time.Duration
+	inBroadcaster(func(*chatState) {
+		timeoutBefore, *clientSendTimeout = *clientSendTimeout, 100*time.Millisecond
+	})
+	defer inBroadcaster(func(*chatState) { *clientSendTimeout = timeoutBefore })
+
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		handleConn(server, func() {})
+		close(done)
+	}()
+	if _, err := io.WriteString(client, formatPrefix+formatText+"\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := dial(t)
+	defer sender.close(t)
+	sender.sync(t, t.Name())
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case <-done:
+			return
+		case <-deadline:
+			t.Fatal("stalled client was not disconnected")
+		case <-time.After(10 * time.Millisecond):
+			sender.send(t, t.Name()+" flood")
+		}
+	}
+}
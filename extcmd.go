@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// 运维人员可以把外部程序注册成聊天室命令，例如 -ext-command weather=/usr/local/bin/weather
+// 只有这里配置的程序可以执行（白名单），参数按空白切分后直接作为 argv 传入，不经过 shell；
+// 程序在超时后被杀掉，输出超过上限的部分被截断，控制字符被去掉
+var (
+	extTimeout   = flag.Duration("ext-timeout", 5*time.Second, "外部命令的最长执行时间")
+	extMaxOutput = flag.Int("ext-max-output", 4096, "外部命令输出的最大字节数，超出部分截断")
+)
+
+// extCommands 实现了 flag.Value，格式为 <name>=<可执行文件的绝对路径>，可重复指定
+type extCommands []extCommand
+
+type extCommand struct {
+	name      string
+	path      string
+	broadcast bool // broadcast 为 true 时输出广播给房间，否则只回复给调用者；
+}
+
+var privateExtCommands, broadcastExtCommands extCommands
+
+func init() {
+	flag.Var(&privateExtCommands, "ext-command", "外部命令，格式为 <name>=<绝对路径>，输出只回复给调用者，可重复指定")
+	flag.Var(&broadcastExtCommands, "ext-broadcast-command", "外部命令，格式为 <name>=<绝对路径>，输出广播给调用者所在的房间，可重复指定")
+}
+
+func (e *extCommands) String() string {
+	parts := make([]string, len(*e))
+	for i, c := range *e {
+		parts[i] = c.name + "=" + c.path
+	}
+	return strings.Join(parts, ",")
+}
+
+func (e *extCommands) Set(value string) error {
+	name, path, ok := strings.Cut(value, "=")
+	if !ok || name == "" || strings.ContainsAny(name, " /") {
+		return errors.New("expected <name>=<path>")
+	}
+	if !filepath.IsAbs(path) {
+		return errors.New("path of external command " + name + " must be absolute")
+	}
+	*e = append(*e, extCommand{name: name, path: path, broadcast: e == &broadcastExtCommands})
+	return nil
+}
+
+// registerExtCommands 在 main 中解析参数后调用，把外部命令加入命令注册表，不能覆盖内置命令
+func registerExtCommands() error {
+	for _, c := range append(privateExtCommands, broadcastExtCommands...) {
+		if _, ok := commands[c.name]; ok {
+			return errors.New("external command /" + c.name + " conflicts with an existing command")
+		}
+		registerCommand(&command{
+			name:    c.name,
+			usage:   "/" + c.name + " [args]",
+			desc:    "外部命令：" + filepath.Base(c.path),
+			handler: c.run,
+		})
+	}
+	return nil
+}
+
+// run 在用户的 handleConn goroutine 中同步执行外部程序，执行期间不读取该用户的输入，
+// 因此每个用户同时最多只有一个外部程序在运行；广播输出和普通消息一样受频率限制
+func (c extCommand) run(user *User, args string) {
+	if c.broadcast && !allowMessage(user, time.Now()) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *extTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.path, strings.Fields(args)...)
+	cmd.Env = []string{"CHAT_COMMAND=" + c.name}
+	cmd.WaitDelay = time.Second
+	out := &cappedBuffer{max: *extMaxOutput}
+	cmd.Stdout = out
+
+	err := cmd.Run()
+	switch {
+	case ctx.Err() != nil:
+		replyError(user, c.name, "/"+c.name+" timed out")
+		return
+	case err != nil:
+		log.Printf("user %d (%s) 执行外部命令 /%s 失败：%v", user.ID, user.Addr, c.name, err)
+		replyError(user, c.name, "/"+c.name+" failed")
+		return
+	}
+
+	text := out.text()
+	if text == "" {
+		text = "(no output)"
+	}
+	if !c.broadcast {
+		user.MessageChannel <- text
+		return
+	}
+	actionChannel <- func(s *chatState) {
+		s.broadcast(&Message{Room: user.Room, Content: fmt.Sprintf("[/%s by %s]\n%s", c.name, user.displayName(), text), Time: time.Now()})
+	}
+}
+
+// cappedBuffer 最多保留 max 字节，多余的输出直接丢弃，避免外部程序输出过多占用内存
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// text 返回去掉控制字符（换行除外）和首尾空白后的输出，被截断时在末尾注明
+func (b *cappedBuffer) text() string {
+	text := strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r != '\n' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(b.buf.String(), "")))
+	if b.truncated {
+		text += "\n[output truncated]"
+	}
+	return text
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"sync"
+)
+
+// 默认由 broadcaster 一个 goroutine 依次给每个接收者投递消息，房间有成千上万人时会成为瓶颈
+// 开启 -fanout-workers 后，人数较多的投递会按用户切分给多个 worker 并行完成
+// broadcaster 会等待所有 worker 完成本条消息后再处理下一条，因此每个用户收到消息的顺序不变
+var (
+	fanoutWorkers = flag.Int("fanout-workers", 0, "并行投递消息的 worker 数量，0 表示由 broadcaster 逐个投递")
+	fanoutMin     = flag.Int("fanout-min", 1024, "接收者达到该数量时才使用 worker 并行投递，人数少时并行的开销大于收益")
+)
+
+// fanoutJob 是交给 worker 的一批接收者
+type fanoutJob struct {
+	users []*User
+	fn    func(*User)
+}
+
+// fanoutPool 是一组常驻的投递 worker
+type fanoutPool struct {
+	workers int
+	jobs    chan fanoutJob
+	wg      sync.WaitGroup
+}
+
+func newFanoutPool(workers int) *fanoutPool {
+	p := &fanoutPool{workers: workers, jobs: make(chan fanoutJob, workers)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range p.jobs {
+				for _, user := range job.users {
+					job.fn(user)
+				}
+				p.wg.Done()
+			}
+		}()
+	}
+	return p
+}
+
+// stop 让所有 worker 退出，之后不能再调用 run
+func (p *fanoutPool) stop() {
+	close(p.jobs)
+}
+
+// run 把接收者平均切分给各个 worker，等全部投递完成后返回
+// 等待期间 broadcaster 处于阻塞状态，worker 读取用户状态不会和 broadcaster 的写入冲突
+func (p *fanoutPool) run(users []*User, fn func(*User)) {
+	chunk := (len(users) + p.workers - 1) / p.workers
+	for start := 0; start < len(users); start += chunk {
+		end := min(start+chunk, len(users))
+		p.wg.Add(1)
+		p.jobs <- fanoutJob{users: users[start:end], fn: fn}
+	}
+	p.wg.Wait()
+}
+
+// fanout 对每个接收者执行 fn，人数较多且开启了 worker 时并行执行，fn 必须能安全地并发调用
+func (s *chatState) fanout(users map[*User]struct{}, fn func(*User)) {
+	if s.pool == nil || len(users) < *fanoutMin {
+		for user := range users {
+			fn(user)
+		}
+		return
+	}
+
+	list := make([]*User, 0, len(users))
+	for user := range users {
+		list = append(list, user)
+	}
+	s.pool.run(list, fn)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// BenchmarkFanout 把 M 条消息（即 b.N 条）依次广播给 N 个用户，比较 broadcaster 逐个投递和 worker 并行投递
+func BenchmarkFanout(b *testing.B) {
+	for _, users := range []int{1000, 10000} {
+		for _, workers := range []int{0, 4, 8} {
+			name := "users=" + strconv.Itoa(users) + "/workers=" + strconv.Itoa(workers)
+			b.Run(name, func(b *testing.B) {
+				defer func(workers, minUsers int) { *fanoutWorkers, *fanoutMin = workers, minUsers }(*fanoutWorkers, *fanoutMin)
+				*fanoutWorkers, *fanoutMin = workers, 0
+
+				s := benchState(b, users, 0)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					s.broadcast(&Message{Seq: i + 1, Content: "message " + strconv.Itoa(i), Time: time.Now()})
+				}
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*users), "ns/delivery")
+			})
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"time"
+)
+
+var (
+	rateLimit       = flag.Float64("rate", 0, "每个用户每秒最多发送的消息数，0 表示不限制")
+	rateBurst       = flag.Int("burst", 5, "频率限制允许的突发消息数")
+	floodViolations = flag.Int("flood-violations", 3, "在 -flood-window 内超过频率限制达到该次数后自动禁言，0 表示不禁言")
+	floodWindow     = flag.Duration("flood-window", 30*time.Second, "统计超限次数的时间窗口")
+	floodMute       = flag.Duration("flood-mute", time.Minute, "自动禁言的时长")
+)
+
+// floodGuard 记录一个用户的发言频率，是一个简单的令牌桶，外加超限次数统计
+// 只在该用户自己的 handleConn goroutine 中使用，因此不需要加锁
+type floodGuard struct {
+	tokens      float64   // tokens 是当前剩余的令牌数；
+	last        time.Time // last 是上一次补充令牌的时间；
+	violations  int       // violations 是当前窗口内超限的次数；
+	windowStart time.Time // windowStart 是当前统计窗口的开始时间；
+	muteUntil   time.Time // muteUntil 是禁言结束时间，零值表示未被禁言；
+}
+
+// allowMessage 判断用户此刻能否发言，不能发言时会私下告知用户原因
+// 频率限制的参数可以在运行时修改，每次调用时从 limits 取一次
+func allowMessage(user *User, now time.Time) bool {
+	lim := limits.Load()
+	if lim.rate <= 0 {
+		return true
+	}
+	g := &user.flood
+
+	if now.Before(g.muteUntil) {
+		user.MessageChannel <- "you are muted for flooding, " + strconv.Itoa(int(g.muteUntil.Sub(now).Seconds())+1) + "s left"
+		return false
+	}
+
+	// 按流逝的时间补充令牌，最多补满 burst 个
+	if g.last.IsZero() {
+		g.tokens = float64(lim.burst)
+	} else {
+		g.tokens += now.Sub(g.last).Seconds() * lim.rate
+		if g.tokens > float64(lim.burst) {
+			g.tokens = float64(lim.burst)
+		}
+	}
+	g.last = now
+
+	if g.tokens >= 1 {
+		g.tokens--
+		return true
+	}
+
+	// 超过频率限制，窗口内多次超限则升级为禁言
+	if now.Sub(g.windowStart) > lim.floodWindow {
+		g.windowStart = now
+		g.violations = 0
+	}
+	g.violations++
+	if lim.floodViolations > 0 && g.violations >= lim.floodViolations {
+		g.violations = 0
+		g.muteUntil = now.Add(lim.floodMute)
+		user.MessageChannel <- "you have been muted for " + lim.floodMute.String() + " for flooding"
+		notifyUnmute(user, lim.floodMute)
+		return false
+	}
+
+	user.MessageChannel <- "rate limit exceeded, message dropped"
+	return false
+}
+
+// notifyUnmute 在禁言结束时通知用户，通知交给 broadcaster 发送，用户已离开时直接忽略
+func notifyUnmute(user *User, after time.Duration) {
+	time.AfterFunc(after, func() {
+		actionChannel <- func(s *chatState) {
+			if _, ok := s.users[user]; ok {
+				s.send(user, "you are no longer muted")
+			}
+		}
+	})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// 每个连接可以通过握手行 "FORMAT json" 或 "FORMAT text" 选择广播消息的格式，默认为文本
+// 握手行只能是连接后的第一行，要在 -format-wait 内发出；之后以 FORMAT 开头的行是普通消息，切换格式要用 /format
+// 人和机器人因此可以连接同一个服务端；命令回复等私下发送的提示仍然是文本，命令失败的回复例外，见 formatError
+// 选择 json 格式后，客户端发来的每一行也要是一个 JSON 对象，见 inputJSON
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+var formatWait = flag.Duration("format-wait", 200*time.Millisecond, "连接建立后等待 FORMAT 握手行的时长，机器人应在连接后立即发送，超时后按文本格式继续；0 表示不等待，只能用 /format 切换")
+
+// ansiPattern 匹配 ANSI 转义序列：CSI 序列（如昵称颜色、加粗）、OSC 序列（如设置终端标题），以及不成序列的 ESC 字节
+var ansiPattern = regexp.MustCompile(`\x1b(\[[0-9;?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)?)?`)
+
+// stripANSI 去掉文本中的 ANSI 转义序列
+func stripANSI(s string) string {
+	if !strings.Contains(s, "\x1b") {
+		return s
+	}
+	return ansiPattern.ReplaceAllString(s, "")
+}
+
+// messageJSON 是 json 格式下一条消息的内容
+type messageJSON struct {
+	Kind      string         `json:"kind"` // message、system 或 history.go 中的消息类型
+	Seq       int            `json:"seq,omitempty"`
+	FromID    int            `json:"from_id,omitempty"`
+	From      string         `json:"from,omitempty"`
+	Room      string         `json:"room,omitempty"`
+	Content   string         `json:"content,omitempty"`
+	Time      time.Time      `json:"time"`
+	Expires   *time.Time     `json:"expires,omitempty"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+}
+
+// formatPrefix 是握手行的前缀
+const formatPrefix = "FORMAT "
+
+func init() {
+	registerCommand(&command{
+		name:    "format",
+		usage:   "/format text|json",
+		desc:    "切换本连接的消息格式；机器人也可以在连接后先发送握手行 FORMAT json",
+		handler: cmdFormat,
+	})
+}
+
+// parseFormat 检查格式名，返回小写的格式
+func parseFormat(name string) (string, error) {
+	format := strings.ToLower(strings.TrimSpace(name))
+	if format != formatText && format != formatJSON {
+		return "", errors.New("unknown format: " + format + ", supported: text, json")
+	}
+	return format, nil
+}
+
+// peekFormat 在 -format-wait 内预读连接开头的几个字节，用来判断第一行是不是握手行
+// 预读到的数据要放回输入流的开头，交给之后的 scanner
+func peekFormat(conn net.Conn, r io.Reader) []byte {
+	if *formatWait <= 0 {
+		return nil
+	}
+	conn.SetReadDeadline(time.Now().Add(*formatWait))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, len(formatPrefix))
+	n, _ := io.ReadFull(r, buf)
+	return buf[:n]
+}
+
+// negotiateFormat 读取第一行的握手行并设置格式，在欢迎信息、登记和回放历史之前调用，这些内容因此都按选择的格式发送
+// 此时用户还没有登记，可以直接修改 format；读不到完整的握手行时返回 false，连接应当断开
+func negotiateFormat(user *User, conn net.Conn, input *bufio.Scanner) bool {
+	conn.SetReadDeadline(time.Now().Add(*formatWait))
+	defer conn.SetReadDeadline(time.Time{})
+	if !input.Scan() {
+		return false
+	}
+	line, ok := verifyLine(input.Text())
+	if !ok {
+		user.MessageChannel <- "integrity check failed, message dropped"
+		return true
+	}
+	format, err := parseFormat(strings.TrimPrefix(line, formatPrefix))
+	if err != nil {
+		user.MessageChannel <- formatError(user, "format", err.Error())
+		return true
+	}
+	user.format = format
+	user.jsonInput = format == formatJSON
+	user.MessageChannel <- formatFor(user, &Message{Content: "format " + format})
+	return true
+}
+
+// cmdFormat 在连接期间切换格式；输入的解析方式只在 handleConn 中使用，在这里直接修改
+func cmdFormat(user *User, args string) {
+	format, err := parseFormat(args)
+	if err != nil {
+		replyError(user, "format", err.Error())
+		return
+	}
+
+	user.jsonInput = format == formatJSON
+	actionChannel <- func(s *chatState) {
+		user.format = format
+		s.send(user, formatFor(user, &Message{Content: "format " + format}))
+	}
+}
+
+// inputJSON 是 json 格式下客户端发来的一行，如 {"cmd":"msg","to":5,"text":"hi"} 或 {"text":"hello"}
+// 指定了 cmd 时按 to、args、text 的顺序用空格拼成命令参数，和文本输入 "/msg 5 hi" 等价；没有 cmd 时 text 作为普通消息发送
+type inputJSON struct {
+	Cmd  string `json:"cmd,omitempty"`  // 命令名，不含前缀 /，可以是别名；
+	To   any    `json:"to,omitempty"`   // to 是命令的目标，用户 ID（数字）或昵称、房间名等（字符串）；
+	Args string `json:"args,omitempty"` // args 是其余参数；
+	Text string `json:"text,omitempty"` // text 是消息正文；
+}
+
+// parseJSONInput 解析 json 格式下的一行输入，不认识的字段视为错误，便于机器人尽早发现拼写错误
+func parseJSONInput(line string) (*inputJSON, error) {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	var in inputJSON
+	if err := dec.Decode(&in); err != nil {
+		return nil, errors.New("invalid JSON input: " + err.Error())
+	}
+	if dec.More() {
+		return nil, errors.New("invalid JSON input: one object per line")
+	}
+	switch in.To.(type) {
+	case nil, string, json.Number:
+	default:
+		return nil, errors.New("invalid JSON input: to must be a number or a string")
+	}
+	if in.Cmd == "" && in.Text == "" {
+		return nil, errors.New("invalid JSON input: cmd or text is required")
+	}
+	to, _ := in.To.(string)
+	for _, field := range []string{in.Cmd, to, in.Args, in.Text} {
+		if hasControl(field) {
+			return nil, errors.New("invalid JSON input: control characters are not allowed")
+		}
+	}
+	in.Cmd = strings.TrimPrefix(in.Cmd, "/")
+	return &in, nil
+}
+
+// hasControl 判断字段中是否有制表符以外的控制字符
+// 文本输入按行读取，不会带换行；JSON 中转义的 \n 却会原样进入消息，输出时被拆成多行，
+// 伪造出其他用户或系统发出的行，开启 -hmac-key 时这些行还会各自带上正确的签名
+func hasControl(s string) bool {
+	return strings.ContainsFunc(s, func(r rune) bool {
+		return r != '\t' && unicode.IsControl(r)
+	})
+}
+
+// args 把 to、args、text 拼成命令参数
+func (in *inputJSON) args() string {
+	var parts []string
+	switch to := in.To.(type) {
+	case string:
+		parts = append(parts, to)
+	case json.Number:
+		parts = append(parts, to.String())
+	}
+	for _, part := range []string{in.Args, in.Text} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.TrimSpace(strings.Join(parts, " "))
+}
+
+// encodeFailedJSON 是消息无法编码时代替它发出的一行
+const encodeFailedJSON = `{"kind":"error","reason":"message could not be encoded"}`
+
+// formatMessageJSON 把消息编码成一行 JSON，保证不带颜色等终端转义序列：
+// 颜色只在文本格式中添加，用户自己输入的转义序列也在这里去掉，解析 JSON 的机器人不会拿到 ESC 字节
+func formatMessageJSON(msg *Message) string {
+	m := messageJSON{Kind: msg.Kind, Seq: msg.Seq, Room: msg.Room, Content: stripANSI(msg.Content), Time: msg.Time}
+	switch {
+	case msg.Kind != "":
+	case msg.From == nil:
+		m.Kind = "system"
+	default:
+		m.Kind = "message"
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	if msg.From != nil {
+		m.FromID = msg.From.ID
+		m.From = stripANSI(msg.From.displayName())
+	}
+	if !msg.Expires.IsZero() {
+		m.Expires = &msg.Expires
+	}
+	if len(msg.Reactions) > 0 {
+		m.Reactions = make(map[string]int, len(msg.Reactions))
+		for emoji, users := range msg.Reactions {
+			m.Reactions[stripANSI(emoji)] = len(users)
+		}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		// 只有时间超出 JSON 能表示的范围时才会编码失败；这时也不能退回带颜色的文本格式，机器人拿到的每一行都要是 JSON
+		return encodeFailedJSON
+	}
+	return string(data)
+}
+
+// formatFor 按接收者选择的格式格式化消息，只能在 broadcaster 中调用
+func formatFor(user *User, msg *Message) string {
+	if user.format == formatJSON {
+		return formatMessageJSON(msg)
+	}
+	return formatMessage(msg)
+}
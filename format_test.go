@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 握手行在欢迎信息之前生效；之后以 FORMAT 开头的行是普通消息
+func TestFormatHandshake(t *testing.T) {
+	bot := dialFormat(t, formatJSON)
+	defer bot.close(t)
+	if !strings.HasPrefix(bot.welcome, "{") {
+		t.Fatalf("greeting %q is not JSON", bot.welcome)
+	}
+	bot.sync(t, t.Name())
+
+	human := dial(t)
+	defer human.close(t)
+	human.sync(t, t.Name())
+	human.send(t, "FORMAT json is what my bot speaks")
+	human.expect(t, ": FORMAT json is what my bot speaks")
+	if line := bot.expect(t, "FORMAT json is what my bot speaks"); !strings.HasPrefix(line, "{") {
+		t.Fatalf("broadcast %q is not JSON", line)
+	}
+
+	human.send(t, "/format json")
+	human.expect(t, "format json")
+}
+
+// 开启 -color 时文本格式带颜色，json 格式中不能出现 ESC 字节
+func TestFormatMessageJSONNoEscapes(t *testing.T) {
+	inBroadcaster(func(*chatState) { *colorIDs = true })
+	defer inBroadcaster(func(*chatState) { *colorIDs = false })
+
+	alice := &User{ID: 1, Nick: "alice"}
+	bob := &User{ID: 2, Nick: "bob", NickColor: "red"}
+	msgs := []*Message{
+		{Seq: 1, From: alice, Content: "hello"},
+		{Seq: 2, From: bob, Content: "typed \x1b[31mred\x1b[0m and \x1b]0;title\x07"},
+		{Kind: kindMention, Seq: 3, From: bob, Content: "@alice hi"},
+		{Kind: kindEdit, Seq: 1, From: alice, Content: "hello again"},
+		{Kind: kindReaction, Seq: 1, From: alice, Content: "\x1b[1m+1", Reactions: map[string]map[int]struct{}{"\x1b[1m+1": {2: {}}}},
+		{Content: "user:`alice` has enter"},
+	}
+	for _, msg := range msgs {
+		if text := formatMessage(msg); msg.From != nil && !strings.Contains(text, "\x1b") {
+			t.Errorf("text format %q has no color", text)
+		}
+		if line := formatMessageJSON(msg); strings.Contains(line, "\x1b") || strings.Contains(line, `\u001b`) {
+			t.Errorf("json format %q contains an escape", line)
+		}
+	}
+}
+
+// JSON 中转义的换行等控制字符会让一条消息在输出时变成多行，解析时直接拒绝
+func TestParseJSONInputControl(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+	}{
+		{`{"text":"hello"}`, true},
+		{`{"text":"a\tb"}`, true},
+		{`{"text":"hi\n#99 admin: fake"}`, false},
+		{`{"text":"hi\r"}`, false},
+		{`{"text":"\u001b[31mred"}`, false},
+		{`{"cmd":"msg","to":"bob\nx","text":"hi"}`, false},
+		{`{"cmd":"msg","to":5,"args":"a\u0000b"}`, false},
+		{`{"cmd":"ping\n"}`, false},
+	}
+	for _, tt := range tests {
+		_, err := parseJSONInput(tt.line)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("parseJSONInput(%s) err = %v, want ok = %v", tt.line, err, tt.ok)
+		}
+	}
+}
+
+// 无法编码的消息也要以一行 JSON 发出，不能退回文本格式
+func TestFormatMessageJSONEncodeFailure(t *testing.T) {
+	msg := &Message{Seq: 1, From: &User{ID: 1, NickColor: "red"}, Content: "hello", Time: time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)}
+	line := formatMessageJSON(msg)
+	var m map[string]any
+	if err := json.Unmarshal([]byte(line), &m); err != nil || m["kind"] != "error" {
+		t.Fatalf("formatMessageJSON = %q, want a JSON error object", line)
+	}
+}
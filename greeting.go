@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var greetingRate = flag.Int("greeting-rate", 0, "每秒新连接数超过该值时，只发送简短的欢迎信息，不再回放历史消息，0 表示不限制")
+
+// greetingLimiter 统计最近一秒内的新连接数，用于抵御大量连接带来的欢迎信息放大
+// 多个 handleConn goroutine 会同时访问，因此需要加锁
+var greetingLimiter struct {
+	sync.Mutex
+	windowStart time.Time
+	count       int
+}
+
+// fullGreeting 判断新连接能否收到完整的欢迎信息（历史消息回放等）
+func fullGreeting(now time.Time) bool {
+	if *greetingRate <= 0 {
+		return true
+	}
+
+	greetingLimiter.Lock()
+	defer greetingLimiter.Unlock()
+	if now.Sub(greetingLimiter.windowStart) >= time.Second {
+		greetingLimiter.windowStart = now
+		greetingLimiter.count = 0
+	}
+	greetingLimiter.count++
+	return greetingLimiter.count <= *greetingRate
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+)
+
+var maxHandshakes = flag.Int("max-concurrent-handshakes", 0, "同时处于握手阶段（验证、等待登记，不含排队）的连接数上限，0 表示不限制；达到上限后暂停接受新连接")
+
+// handshakeSlots 是握手阶段的信号量，由 main 根据 -max-concurrent-handshakes 创建，为 nil 表示不限制
+var handshakeSlots chan struct{}
+
+// acquireHandshake 占用一个握手名额，名额用完时记录日志并阻塞，直到有连接完成握手
+// 返回的 release 用于归还名额，可以重复调用，只有第一次生效
+func acquireHandshake() (release func()) {
+	if handshakeSlots == nil {
+		return func() {}
+	}
+	select {
+	case handshakeSlots <- struct{}{}:
+	default:
+		log.Printf("握手中的连接已达上限 %d，空出名额前不再接受新连接", cap(handshakeSlots))
+		handshakeSlots <- struct{}{}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-handshakeSlots })
+	}
+}
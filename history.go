@@ -0,0 +1,280 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	historySize   = flag.Int("history", 50, "每个房间保留的最近消息条数，/edit、/delete 只能修改其中的消息，0 表示不保留")
+	searchResults = flag.Int("search-results", 10, "/search 最多返回的结果条数")
+	maxTTL        = flag.Duration("max-ttl", 24*time.Hour, "/ttl 消息允许的最长存活时间")
+	historyReplay = flag.Int("history-replay", 20, "进入房间或执行 /history 时最多回放的最近消息条数，0 表示不回放")
+	replayBytes   = flag.Int("history-replay-bytes", 16<<10, "一次回放历史消息的最大字节数，避免每个新连接都带来大量的出站数据")
+)
+
+// 消息类型，为空表示普通消息（用户发言或系统通知）
+const (
+	kindEdit     = "edit"     // 修改消息，Seq 为被修改消息的序号；
+	kindDelete   = "delete"   // 删除消息，Seq 为被删除消息的序号；
+	kindReaction = "reaction" // 表情回应，Seq 为被回应消息的序号，Content 为表情；
+	kindMention  = "mention"  // 提及，只发给被提及的用户，代替原消息以突出显示；
+
+	kindTyping = "typing" // 房间内正在输入的用户汇总，Content 为提示文本，见 typing.go；
+)
+
+func init() {
+	registerCommand(&command{
+		name:    "edit",
+		usage:   "/edit <text>",
+		desc:    "修改自己发出的最后一条消息",
+		handler: cmdEdit,
+	})
+	registerCommand(&command{
+		name:    "delete",
+		usage:   "/delete",
+		desc:    "删除自己发出的最后一条消息",
+		handler: cmdDelete,
+	})
+	registerCommand(&command{
+		name:    "search",
+		usage:   "/search <term>",
+		desc:    "在当前房间的最近消息中搜索（不区分大小写）",
+		handler: cmdSearch,
+	})
+	registerCommand(&command{
+		name:    "history",
+		usage:   "/history",
+		desc:    "查看当前房间的最近消息",
+		handler: cmdHistory,
+	})
+	registerCommand(&command{
+		name:    "last",
+		usage:   "/last <id|nick>",
+		desc:    "查看某个用户最近的一条消息",
+		handler: cmdLast,
+	})
+	registerCommand(&command{
+		name:    "ttl",
+		usage:   "/ttl <seconds> <text>",
+		desc:    "发送阅后即焚消息，过期后从最近消息中删除",
+		handler: cmdTTL,
+	})
+}
+
+// record 为用户消息分配序号并放入所属房间的最近消息缓冲区，超出容量时丢弃最早的消息
+// 序号在所有房间之间全局递增，每个房间的缓冲区各自最多保留 -history 条
+func (s *chatState) record(msg *Message) {
+	s.nextSeq++
+	msg.Seq = s.nextSeq
+	msg.From.lastSeq = msg.Seq
+
+	r, ok := s.rooms[msg.Room]
+	if !ok || *historySize <= 0 {
+		return
+	}
+	r.history = append(r.history, msg)
+	if len(r.history) > *historySize {
+		r.history = r.history[len(r.history)-*historySize:]
+	}
+}
+
+// roomHistory 返回房间的最近消息，房间不存在时返回 nil
+func (s *chatState) roomHistory(name string) []*Message {
+	if r, ok := s.rooms[name]; ok {
+		return r.history
+	}
+	return nil
+}
+
+// replayHistory 把当前房间最近的消息发给用户，最多 -history-replay 条、-history-replay-bytes 字节，超出时只发最新的部分
+// 回放合并成一条多行消息发送，避免刚连接的用户 MessageChannel 被占满而丢弃后续消息
+func (s *chatState) replayHistory(user *User) bool {
+	var lines []string
+	size := 0
+	history := s.roomHistory(user.Room)
+	for i := len(history) - 1; i >= 0 && len(lines) < *historyReplay; i-- {
+		line := formatFor(user, history[i])
+		if size += len(line) + 1; size > *replayBytes {
+			break
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return false
+	}
+	slices.Reverse(lines)
+	s.send(user, "--- recent messages in room "+user.Room+" ---\n"+strings.Join(lines, "\n"))
+	return true
+}
+
+// pruneHistory 从各房间的最近消息中删除已经过期的阅后即焚消息
+func (s *chatState) pruneHistory(now time.Time) {
+	for _, r := range s.rooms {
+		r.unpinExpired(now)
+		r.history = slices.DeleteFunc(r.history, func(msg *Message) bool {
+			return !msg.Expires.IsZero() && !now.Before(msg.Expires)
+		})
+	}
+}
+
+// findHistory 在各房间的最近消息中查找指定序号的消息，返回所在的房间和位置，找不到时返回 nil, -1
+func (s *chatState) findHistory(seq int) (*room, int) {
+	for _, r := range s.rooms {
+		for i, msg := range r.history {
+			if msg.Seq == seq {
+				return r, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+// lastOwnMessage 返回用户最后一条仍在缓冲区中的消息所在的房间和位置，没有时返回 nil, -1
+// 用户换了房间之后，仍然可以修改或删除在原房间发出的最后一条消息
+func (s *chatState) lastOwnMessage(user *User) (*room, int) {
+	if user.lastSeq == 0 {
+		return nil, -1
+	}
+	r, i := s.findHistory(user.lastSeq)
+	if i < 0 || r.history[i].From != user {
+		return nil, -1
+	}
+	return r, i
+}
+
+func cmdEdit(user *User, args string) {
+	if args = normalizeSpace(args); args == "" {
+		replyError(user, "edit", "usage: /edit <text>")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		r, i := s.lastOwnMessage(user)
+		if i < 0 {
+			s.fail(user, "edit", "no recent message to edit")
+			return
+		}
+		orig := r.history[i]
+		orig.Content = args
+		s.broadcast(&Message{Kind: kindEdit, From: user, Room: orig.Room, Seq: orig.Seq, Content: args})
+	}
+}
+
+func cmdDelete(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		r, i := s.lastOwnMessage(user)
+		if i < 0 {
+			s.fail(user, "delete", "no recent message to delete")
+			return
+		}
+		orig := r.history[i]
+		r.history = append(r.history[:i], r.history[i+1:]...)
+		user.lastSeq = 0
+		if r.pinned == orig {
+			r.pinned = nil
+		}
+		s.broadcast(&Message{Kind: kindDelete, From: user, Room: orig.Room, Seq: orig.Seq})
+	}
+}
+
+// cmdSearch 从新到旧搜索当前房间的最近消息，最多返回 -search-results 条，结果只发给调用者
+func cmdSearch(user *User, args string) {
+	if args == "" {
+		replyError(user, "search", "usage: /search <term>")
+		return
+	}
+	term := strings.ToLower(args)
+
+	actionChannel <- func(s *chatState) {
+		var matches []*Message
+		history := s.roomHistory(user.Room)
+		for i := len(history) - 1; i >= 0 && len(matches) < *searchResults; i-- {
+			msg := history[i]
+			if strings.Contains(strings.ToLower(msg.Content), term) {
+				matches = append(matches, msg)
+			}
+		}
+
+		// 结果合并成一条多行消息发送，避免占满用户的 MessageChannel 导致丢弃
+		lines := []string{strconv.Itoa(len(matches)) + " matches for " + strconv.Quote(args) + ":"}
+		for i := len(matches) - 1; i >= 0; i-- {
+			lines = append(lines, formatFor(user, matches[i]))
+		}
+		s.send(user, strings.Join(lines, "\n"))
+	}
+}
+
+func cmdHistory(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		if !s.replayHistory(user) {
+			s.send(user, "no recent messages in room "+user.Room)
+		}
+	}
+}
+
+// cmdLast 在调用者可以进入的房间的最近消息中，查找指定用户序号最大的一条，结果只发给调用者
+// 按 ID 或昵称匹配发送者，发送者已经离开时也能找到
+func cmdLast(user *User, args string) {
+	if args == "" {
+		replyError(user, "last", "usage: /last <id|nick>")
+		return
+	}
+	id, err := strconv.Atoi(args)
+	from := func(u *User) bool {
+		if err == nil {
+			return u.ID == id
+		}
+		return strings.EqualFold(u.Nick, args)
+	}
+
+	actionChannel <- func(s *chatState) {
+		var last *Message
+		for _, r := range s.rooms {
+			if !r.canJoin(user) {
+				continue
+			}
+			for i := len(r.history) - 1; i >= 0; i-- {
+				if msg := r.history[i]; from(msg.From) {
+					if last == nil || msg.Seq > last.Seq {
+						last = msg
+					}
+					break
+				}
+			}
+		}
+		if last == nil {
+			s.fail(user, "last", "no recent message from "+args)
+			return
+		}
+		s.send(user, "["+last.Room+"] "+formatFor(user, last))
+	}
+}
+
+// cmdTTL 发送一条阅后即焚消息，和普通消息一样受频率限制
+// 服务端在消息过期后把它从最近消息中删除，支持的客户端可以据此清除显示
+func cmdTTL(user *User, args string) {
+	secs, text, _ := strings.Cut(args, " ")
+	seconds, err := strconv.Atoi(secs)
+	text = normalizeSpace(strings.TrimSpace(text))
+	if err != nil || seconds <= 0 || text == "" {
+		replyError(user, "ttl", "usage: /ttl <seconds> <text>")
+		return
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if ttl > *maxTTL {
+		replyError(user, "ttl", "ttl is too long, max "+maxTTL.String())
+		return
+	}
+
+	now := time.Now()
+	if !allowMessage(user, now) {
+		return
+	}
+	if !submitMessage(&Message{From: user, Content: text, Time: now, Expires: now.Add(ttl)}) {
+		user.MessageChannel <- "server busy, message dropped"
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"strings"
+)
+
+var hmacKey = flag.String("hmac-key", "", "与客户端共享的消息签名密钥，设置后每行消息都附带 HMAC，并拒绝签名不正确的输入（网页客户端无法签名）")
+
+// signLine 在一行文本后面附上以制表符分隔的 HMAC-SHA256 签名，没有配置密钥时原样返回
+func signLine(line string) string {
+	if *hmacKey == "" {
+		return line
+	}
+	mac := hmac.New(sha256.New, []byte(*hmacKey))
+	mac.Write([]byte(line))
+	return line + "\t" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyLine 校验并去掉一行文本末尾的签名，没有配置密钥时原样返回
+func verifyLine(line string) (string, bool) {
+	if *hmacKey == "" {
+		return line, true
+	}
+	i := strings.LastIndexByte(line, '\t')
+	if i < 0 {
+		return "", false
+	}
+	sum, err := hex.DecodeString(line[i+1:])
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, []byte(*hmacKey))
+	mac.Write([]byte(line[:i]))
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return "", false
+	}
+	return line[:i], true
+}
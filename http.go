@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+)
+
+var httpAddr = flag.String("http-addr", "", "HTTP 运维接口的监听地址（如 127.0.0.1:8080），提供 /healthz 和 /metrics，为空表示不启用")
+
+// startHTTP 启动 HTTP 运维接口，这些请求不会在聊天室中登记用户
+func startHTTP(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		log.Println("HTTP 运维接口监听：", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("HTTP 运维接口异常退出：", err)
+		}
+	}()
+	return srv
+}
+
+// handleHealthz 在 broadcaster 能及时处理请求时返回 200，否则返回 503
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !broadcasterAlive(time.Second) {
+		http.Error(w, "broadcaster not responding", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK\n"))
+}
+
+// broadcasterAlive 通过 actionChannel 向 broadcaster 发送一个空操作，在 timeout 内执行完毕说明它运行正常
+func broadcasterAlive(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	done := make(chan struct{})
+	select {
+	case actionChannel <- func(*chatState) { close(done) }:
+	case <-timer.C:
+		return false
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
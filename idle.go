@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"time"
+)
+
+var (
+	idleTimeout = flag.Duration("idle-timeout", 0, "用户无输入超过该时长后断开连接，0 表示不限制")
+	idleWarn    = flag.Float64("idle-warn", 0.8, "空闲时间达到 -idle-timeout 的该比例时提醒用户，0 表示不提醒")
+)
+
+// idleWatch 负责空闲断开：通过读超时断开连接，并用一个定时器在断开前提醒用户
+// 用户有任何输入都会重新计时
+type idleWatch struct {
+	conn      net.Conn
+	warn      *time.Timer
+	warnAfter time.Duration
+}
+
+// watchIdle 开始监视用户的空闲时间，没有配置 -idle-timeout 时返回 nil
+func watchIdle(user *User, conn net.Conn) *idleWatch {
+	if *idleTimeout <= 0 {
+		return nil
+	}
+
+	w := &idleWatch{conn: conn}
+	if *idleWarn > 0 {
+		w.warnAfter = time.Duration(float64(*idleTimeout) * *idleWarn)
+		remaining := (*idleTimeout - w.warnAfter).Round(time.Second)
+		w.warn = time.AfterFunc(w.warnAfter, func() {
+			actionChannel <- func(s *chatState) {
+				if _, ok := s.users[user]; ok {
+					s.send(user, "you will be disconnected in "+remaining.String()+" due to inactivity")
+				}
+			}
+		})
+	}
+	w.touch()
+	return w
+}
+
+// touch 在用户有输入时调用，重新开始计时
+func (w *idleWatch) touch() {
+	if w == nil {
+		return
+	}
+	w.conn.SetReadDeadline(time.Now().Add(*idleTimeout))
+	if w.warn != nil {
+		w.warn.Reset(w.warnAfter)
+	}
+}
+
+func (w *idleWatch) stop() {
+	if w != nil && w.warn != nil {
+		w.warn.Stop()
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// 踢人理由的最大长度（按字符计算）
+const maxKickReasonLen = 100
+
+func init() {
+	registerCommand(&command{
+		name:      "kick",
+		usage:     "/kick <id|nick> [reason]",
+		desc:      "断开用户的连接，理由会私下告知对方，并在其所在房间公布",
+		adminOnly: true,
+		handler:   cmdKick,
+	})
+	registerCommand(&command{
+		name:      "kickall",
+		usage:     "/kickall",
+		desc:      "断开当前房间内除自己以外所有用户的连接",
+		adminOnly: true,
+		handler:   cmdKickAll,
+	})
+	registerCommand(&command{
+		name:      "kickallserver",
+		usage:     "/kickallserver",
+		desc:      "断开聊天室内除自己以外所有用户的连接",
+		adminOnly: true,
+		handler:   cmdKickAllServer,
+	})
+}
+
+// kick 给用户发送断开提醒，并让其 handleConn 的读循环立即返回，之后和断开连接一样经由 leavingChannel 注销
+// 这里只做标记，不修改 s.users，因此可以在遍历 s.users 时调用；只能在 broadcaster 中调用
+// reason 为空表示没有理由
+func (s *chatState) kick(user *User, by *User, reason string) {
+	if user.kicked.Swap(true) {
+		return
+	}
+	notice := "you have been disconnected by admin " + by.displayName()
+	if reason != "" {
+		notice += " (" + reason + ")"
+	}
+	s.sendPriority(user, notice)
+	user.conn.SetReadDeadline(time.Now())
+}
+
+// cmdKick 踢出单个用户；被踢出的用户不再有离开提醒，改由这里在其所在房间公布
+func cmdKick(user *User, args string) {
+	target, reason, _ := strings.Cut(args, " ")
+	reason = normalizeSpace(strings.TrimSpace(stripControl(reason)))
+	if target == "" {
+		replyError(user, "kick", "usage: /kick <id|nick> [reason]")
+		return
+	}
+	if utf8.RuneCountInString(reason) > maxKickReasonLen {
+		replyError(user, "kick", "kick reason is too long, max "+strconv.Itoa(maxKickReasonLen)+" characters")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "kick") {
+			return
+		}
+		u := s.lookupUser(target)
+		switch {
+		case u == nil:
+			s.fail(user, "kick", "no such user: "+target)
+			return
+		case u == user:
+			s.fail(user, "kick", "you cannot kick yourself")
+			return
+		}
+		s.kick(u, user, reason)
+		log.Printf("管理员 %d 踢出了用户 %d，理由：%q", user.ID, u.ID, reason)
+		notice := "user:`" + u.displayName() + "` was kicked"
+		if reason != "" {
+			notice += " (" + reason + ")"
+		}
+		s.broadcast(&Message{Room: u.Room, Content: notice})
+		if u.Room != user.Room {
+			s.send(user, "kicked user "+u.displayName()+" from room "+u.Room)
+		}
+	}
+}
+
+func cmdKickAll(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "kickall") {
+			return
+		}
+		r := s.rooms[user.Room]
+		n := 0
+		for member := range r.members {
+			if member != user {
+				s.kick(member, user, "")
+				n++
+			}
+		}
+		log.Printf("管理员 %d 踢出了房间 %s 的 %d 个用户", user.ID, r.name, n)
+		if n == 0 {
+			s.send(user, "no other users in room "+r.name)
+			return
+		}
+		s.broadcast(&Message{Content: "admin " + user.displayName() + " disconnected " + strconv.Itoa(n) + " users in room " + r.name})
+	}
+}
+
+func cmdKickAllServer(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "kickallserver") {
+			return
+		}
+		n := 0
+		for u := range s.users {
+			if u != user {
+				s.kick(u, user, "")
+				n++
+			}
+		}
+		log.Printf("管理员 %d 踢出了全部 %d 个用户", user.ID, n)
+		s.send(user, "kicked "+strconv.Itoa(n)+" users")
+	}
+}
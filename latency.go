@@ -0,0 +1,131 @@
+package main
+
+import (
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runtime.ReadMemStats 会短暂地暂停所有 goroutine，/load 最多每隔 memStatsInterval 读取一次，其间复用上次的结果
+const memStatsInterval = 5 * time.Second
+
+// memStats 是最近一次读取的内存统计，只在 broadcaster 中访问
+var memStats struct {
+	runtime.MemStats
+	at time.Time
+}
+
+func init() {
+	registerCommand(&command{
+		name:      "latency",
+		usage:     "/latency",
+		desc:      "查看每个在线用户发送缓冲区的占用和累计丢弃数，积压最多的排在前面",
+		adminOnly: true,
+		handler:   cmdLatency,
+	})
+	registerCommand(&command{
+		name:      "load",
+		usage:     "/load",
+		desc:      "查看服务端当前的负载：goroutine 数、在线用户、消息队列、内存和丢弃的消息数",
+		adminOnly: true,
+		handler:   cmdLoad,
+	})
+}
+
+// backlog 返回用户两个消息通道中还没写出的消息数，用来衡量这个连接落后了多少
+func (u *User) backlog() int {
+	return len(u.MessageChannel) + len(u.priorityChannel)
+}
+
+// cmdLatency 由 broadcaster 生成报告：按积压从多到少排列，积压相同时丢弃多的在前，便于管理员找出该踢掉的慢连接
+func cmdLatency(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "latency") {
+			return
+		}
+
+		// 积压和丢弃数由写 goroutine 并发修改，先取一次快照再排序，否则比较结果前后不一致
+		type entry struct {
+			user    *User
+			backlog int
+			dropped int64
+		}
+		entries := make([]entry, 0, len(s.users))
+		for u := range s.users {
+			entries = append(entries, entry{u, u.backlog(), u.droppedCount.Load()})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].backlog != entries[j].backlog {
+				return entries[i].backlog > entries[j].backlog
+			}
+			if entries[i].dropped != entries[j].dropped {
+				return entries[i].dropped > entries[j].dropped
+			}
+			return entries[i].user.ID < entries[j].user.ID
+		})
+
+		lines := []string{"send buffers of " + strconv.Itoa(len(entries)) + " users, most backed-up first:"}
+		for _, e := range entries {
+			line := "  " + strconv.Itoa(e.user.ID)
+			if e.user.Nick != "" {
+				line += " " + e.user.Nick
+			}
+			size := cap(e.user.MessageChannel) + cap(e.user.priorityChannel)
+			line += ": queued " + strconv.Itoa(e.backlog) + "/" + strconv.Itoa(size) +
+				", dropped " + strconv.FormatInt(e.dropped, 10)
+			lines = append(lines, line)
+		}
+		s.send(user, strings.Join(lines, "\n"))
+	}
+}
+
+// cmdLoad 由 broadcaster 汇总当前的负载，私下回复给管理员；和 /metrics 不同，只是给人在终端里快速查看
+func cmdLoad(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "load") {
+			return
+		}
+
+		now := time.Now()
+		if now.Sub(memStats.at) >= memStatsInterval {
+			runtime.ReadMemStats(&memStats.MemStats)
+			memStats.at = now
+		}
+		var queued int
+		var dropped int64
+		for u := range s.users {
+			queued += u.backlog()
+			dropped += u.droppedCount.Load()
+		}
+
+		lines := []string{
+			"uptime " + now.Sub(startTime).Round(time.Second).String() +
+				", goroutines " + strconv.Itoa(runtime.NumGoroutine()),
+			"users " + strconv.Itoa(len(s.users)) + " online, " + strconv.Itoa(len(s.waiting)) + " waiting" +
+				", " + strconv.Itoa(queued) + " messages queued to users",
+			"message queue " + strconv.Itoa(len(messageChannel)) + "/" + strconv.Itoa(cap(messageChannel)) +
+				", full " + strconv.FormatInt(queueFullCount.Load(), 10) + " times",
+			"dropped: " + strconv.FormatInt(shedCount.Load(), 10) + " by the server queue, " +
+				strconv.FormatInt(dropped, 10) + " to slow users online",
+			"memory: heap " + formatBytes(memStats.HeapAlloc) + " in use, " + formatBytes(memStats.Sys) + " from the OS" +
+				", " + strconv.FormatUint(uint64(memStats.NumGC), 10) + " GCs" +
+				" (as of " + now.Sub(memStats.at).Round(time.Second).String() + " ago)",
+		}
+		s.send(user, strings.Join(lines, "\n"))
+	}
+}
+
+// formatBytes 把字节数换算成便于阅读的单位
+func formatBytes(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return strconv.FormatFloat(float64(n)/(1<<30), 'f', 1, 64) + "GiB"
+	case n >= 1<<20:
+		return strconv.FormatFloat(float64(n)/(1<<20), 'f', 1, 64) + "MiB"
+	case n >= 1<<10:
+		return strconv.FormatFloat(float64(n)/(1<<10), 'f', 1, 64) + "KiB"
+	}
+	return strconv.FormatUint(n, 10) + "B"
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+)
+
+// addrList 实现了 flag.Value，允许 -addr 重复出现，或者一次用逗号分隔多个地址
+type addrList []string
+
+func (a *addrList) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *addrList) Set(value string) error {
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			*a = append(*a, addr)
+		}
+	}
+	return nil
+}
+
+// listen 根据地址创建监听，以 unix: 开头的地址监听 UNIX socket，其余按 TCP 处理
+func listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// acceptLoop 不断接受新连接，监听被关闭后返回
+// 开启了 -max-concurrent-handshakes 时，先占用一个握手名额再接受连接，名额用完时不再接受，由内核的 backlog 暂存
+// 开启了 -conn-workers 时，worker 和等待队列都满了之后同样不再接受，见 pool.go
+func acceptLoop(listener net.Listener) {
+	log.Println("开始监听：", listener.Addr())
+	for {
+		release := acquireHandshake()
+		conn, err := listener.Accept()
+		if err != nil {
+			release()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println("接受连接失败：", err)
+			continue
+		}
+		serveConn(conn, release)
+	}
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
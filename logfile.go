@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"sync"
+)
+
+var logFile = flag.String("log-file", "", "服务端日志写入的文件（追加写入），为空时输出到标准错误；收到 SIGHUP 或执行 /rotatelog 时重新打开，配合 logrotate 使用")
+
+func init() {
+	registerCommand(&command{
+		name:      "rotatelog",
+		usage:     "/rotatelog",
+		desc:      "重新打开日志文件，用于日志轮转",
+		adminOnly: true,
+		handler:   cmdRotateLog,
+	})
+}
+
+// reopenFile 是可以在运行时重新打开的日志文件
+// 每次写入都持有锁，重新打开时先关闭旧文件再换上新文件，任意一行日志要么完整写入旧文件，要么写入新文件
+type reopenFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// serverLog 是 -log-file 对应的日志文件，没有设置时为 nil
+var serverLog *reopenFile
+
+func openLogFile(path string) (*reopenFile, error) {
+	r := &reopenFile{path: path}
+	if err := r.reopen(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *reopenFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Write(p)
+}
+
+// reopen 按原路径重新打开文件，logrotate 移走旧文件后，之后的日志会写入新建的文件
+func (r *reopenFile) reopen() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		r.f.Sync()
+		r.f.Close()
+	}
+	r.f = f
+	return nil
+}
+
+func cmdRotateLog(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "rotatelog") {
+			return
+		}
+		if serverLog == nil {
+			s.fail(user, "rotatelog", "no log file configured")
+			return
+		}
+		if err := serverLog.reopen(); err != nil {
+			s.fail(user, "rotatelog", "rotate log failed: "+err.Error())
+			return
+		}
+		log.Printf("user %d (%s) 重新打开了日志文件", user.ID, user.Addr)
+		s.send(user, "log file reopened")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "strings"
+
+// mentionNames 返回消息中提及的名字：以 @ 开头的单词去掉 @ 即为名字
+// 昵称允许包含标点，因此同时保留原样和去掉末尾标点两种写法，如 "@bob," 会得到 "bob," 和 "bob"
+func mentionNames(content string) []string {
+	var names []string
+	for _, word := range strings.Fields(content) {
+		name, ok := strings.CutPrefix(word, "@")
+		if !ok || name == "" {
+			continue
+		}
+		names = append(names, name)
+		if trimmed := strings.TrimRight(name, ",.:;!?"); trimmed != name && trimmed != "" {
+			names = append(names, trimmed)
+		}
+	}
+	return names
+}
+
+// mentionedUsers 根据昵称表解析消息中提及的在线用户：@昵称（不区分大小写）或 @ID，一条消息可以提及多个用户
+// 只有用户发言和修改后的消息会解析提及，发送者提及自己不算
+func (s *chatState) mentionedUsers(msg *Message) map[*User]struct{} {
+	if msg.From == nil || (msg.Kind != "" && msg.Kind != kindEdit) {
+		return nil
+	}
+	var mentioned map[*User]struct{}
+	for _, name := range mentionNames(msg.Content) {
+		user := s.lookupUser(name)
+		if user == nil || user == msg.From {
+			continue
+		}
+		if mentioned == nil {
+			mentioned = make(map[*User]struct{})
+		}
+		mentioned[user] = struct{}{}
+	}
+	return mentioned
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// 提供给 Prometheus 抓取的指标，挂在 -http-addr 的 /metrics 上，使用文本格式，不依赖第三方库
+
+// histogram 是累计分布的直方图，buckets 为各区间的上界（包含），会被多个 handleConn goroutine 同时更新，因此使用原子操作
+type histogram struct {
+	buckets []float64
+	counts  []atomic.Int64 // counts[i] 是落在 (buckets[i-1], buckets[i]] 的次数，最后一个对应 +Inf；
+	sum     atomic.Int64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]atomic.Int64, len(buckets)+1)}
+}
+
+func (h *histogram) observe(v int) {
+	i := 0
+	for i < len(h.buckets) && float64(v) > h.buckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(v))
+}
+
+// write 按 Prometheus 文本格式输出直方图，bucket 的计数是累计的
+func (h *histogram) write(w http.ResponseWriter, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var total int64
+	for i, le := range h.buckets {
+		total += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(le, 'g', -1, 64), total)
+	}
+	total += h.counts[len(h.buckets)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, total)
+	fmt.Fprintf(w, "%s_sum %d\n%s_count %d\n", name, h.sum.Load(), name, total)
+}
+
+// inboundMessageBytes 统计用户每一行输入的字节数（包括命令），用于设置 -max-line 和 -read-buffer 等参数
+var inboundMessageBytes = newHistogram(16, 32, 64, 128, 256, 512, 1024, 4096, 16384, 65536)
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	inboundMessageBytes.write(w, "chat_inbound_message_bytes", "Size of each line received from clients, in bytes.")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var motdFile = flag.String("motd", "", "今日消息（MOTD）文件，用户进入时显示，也可以用 /motd 查看；每次显示时重新读取，修改文件后无需重启；管理员用 /setmotd 修改时会写回该文件")
+
+// MOTD 的长度限制，按字符和行数计算
+const (
+	maxMOTDLen   = 1024
+	maxMOTDLines = 20
+)
+
+// runtimeMOTD 是没有配置 -motd 时用 /setmotd 设置的 MOTD，会被 handleConn 读取，因此用锁保护
+var runtimeMOTD struct {
+	sync.Mutex
+	text string
+}
+
+func init() {
+	registerCommand(&command{
+		name:    "motd",
+		usage:   "/motd",
+		desc:    "查看今日消息",
+		handler: cmdMOTD,
+	})
+	registerCommand(&command{
+		name:      "setmotd",
+		usage:     "/setmotd [text]",
+		desc:      "修改今日消息；不带参数时进入粘贴模式，逐行输入，单独一行 . 结束，直接输入 . 表示清空",
+		adminOnly: true,
+		aliases:   []string{"motd-set"},
+		handler:   cmdSetMOTD,
+	})
+}
+
+// readMOTD 读取 MOTD 文件，去掉首尾空行，读取失败时返回空字符串；没有配置 -motd 时返回 /setmotd 设置的内容
+func readMOTD() string {
+	if *motdFile == "" {
+		runtimeMOTD.Lock()
+		defer runtimeMOTD.Unlock()
+		return runtimeMOTD.text
+	}
+	data, err := os.ReadFile(*motdFile)
+	if err != nil {
+		log.Println("读取 MOTD 失败：", err)
+		return ""
+	}
+	return strings.Trim(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+}
+
+// sendMOTD 把 MOTD 作为一条多行消息私下发给用户，没有 MOTD 时返回 false
+func sendMOTD(user *User) bool {
+	motd := readMOTD()
+	if motd == "" {
+		return false
+	}
+	user.MessageChannel <- "--- message of the day ---\n" + motd
+	return true
+}
+
+func cmdMOTD(user *User, _ string) {
+	if !sendMOTD(user) {
+		user.MessageChannel <- "no message of the day"
+	}
+}
+
+// validateMOTD 检查 MOTD 的长度和行数，并去掉每行中的控制字符
+func validateMOTD(lines []string) (string, error) {
+	if len(lines) > maxMOTDLines {
+		return "", errors.New("message of the day is too long, max " + strconv.Itoa(maxMOTDLines) + " lines")
+	}
+	for i, line := range lines {
+		lines[i] = stripControl(line)
+	}
+	motd := strings.Trim(strings.Join(lines, "\n"), "\n")
+	if utf8.RuneCountInString(motd) > maxMOTDLen {
+		return "", errors.New("message of the day is too long, max " + strconv.Itoa(maxMOTDLen) + " characters")
+	}
+	return motd, nil
+}
+
+// storeMOTD 保存新的 MOTD：配置了 -motd 时写回文件，之后的显示都从文件读取；否则只保存在内存中，重启后失效
+func storeMOTD(motd string) error {
+	if *motdFile != "" {
+		data := motd
+		if data != "" {
+			data += "\n"
+		}
+		return os.WriteFile(*motdFile, []byte(data), 0o644)
+	}
+	runtimeMOTD.Lock()
+	runtimeMOTD.text = motd
+	runtimeMOTD.Unlock()
+	return nil
+}
+
+// cmdSetMOTD 带参数时直接把 MOTD 设为这一行，不带参数时先确认是管理员，再让 handleConn 进入粘贴模式
+func cmdSetMOTD(user *User, args string) {
+	if args != "" {
+		setMOTD(user, []string{args})
+		return
+	}
+
+	// 在这里等待 broadcaster 的答复，非管理员的后续输入不会被当作 MOTD 吞掉
+	admin := make(chan bool, 1)
+	actionChannel <- func(s *chatState) {
+		admin <- s.requireAdmin(user, "setmotd")
+	}
+	if !<-admin {
+		return
+	}
+	user.motdPaste = []string{}
+	user.MessageChannel <- "enter the message of the day, end with a single . on its own line"
+}
+
+// handleMOTDPaste 在粘贴模式下收集一行 MOTD，读到单独的 . 时结束并保存，不在粘贴模式时返回 false
+// 只在该用户的 handleConn goroutine 中调用
+func handleMOTDPaste(user *User, line string) bool {
+	if user.motdPaste == nil {
+		return false
+	}
+	if line != "." {
+		user.motdPaste = append(user.motdPaste, line)
+		if len(user.motdPaste) > maxMOTDLines {
+			user.motdPaste = nil
+			replyError(user, "setmotd", "message of the day is too long, max "+strconv.Itoa(maxMOTDLines)+" lines, discarded")
+		}
+		return true
+	}
+	lines := user.motdPaste
+	user.motdPaste = nil
+	setMOTD(user, lines)
+	return true
+}
+
+// setMOTD 检查并保存新的 MOTD，管理员身份在 broadcaster 中确认，保存之后发给管理员预览
+func setMOTD(user *User, lines []string) {
+	motd, err := validateMOTD(lines)
+	if err != nil {
+		replyError(user, "setmotd", err.Error())
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "setmotd") {
+			return
+		}
+		if err := storeMOTD(motd); err != nil {
+			log.Println("保存 MOTD 失败：", err)
+			s.fail(user, "setmotd", "failed to save message of the day: "+err.Error())
+			return
+		}
+		log.Printf("管理员 %d 修改了 MOTD", user.ID)
+		if motd == "" {
+			s.send(user, "message of the day cleared")
+			return
+		}
+		s.send(user, "message of the day updated:\n"+motd)
+	}
+}
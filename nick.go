@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// 昵称最大长度（按字符计算）
+const maxNickLen = 16
+
+// /findnick 最多返回的结果数
+const maxFindNick = 20
+
+// nickColors 是 /nickcolor 可选的调色板，值为对应的 ANSI 前景色
+var nickColors = map[string]string{
+	"red":     "\033[31m",
+	"green":   "\033[32m",
+	"yellow":  "\033[33m",
+	"blue":    "\033[34m",
+	"magenta": "\033[35m",
+	"cyan":    "\033[36m",
+	"white":   "\033[37m",
+}
+
+var nickInterval = flag.Duration("nick-interval", 30*time.Second, "同一用户两次修改昵称的最小间隔，第一次设置昵称不受限制，0 表示不限制")
+
+var colorIDs = flag.Bool("color", false, "没有用 /nickcolor 选择颜色的用户，按用户 ID 分配固定的显示颜色；机器人可以使用 FORMAT json 或客户端去掉颜色")
+
+// idColors 是按 ID 自动分配的颜色，ID 对其长度取模，同一个用户的颜色始终不变，相邻 ID 的颜色也不同
+var idColors = []string{"\033[31m", "\033[32m", "\033[33m", "\033[34m", "\033[35m", "\033[36m"}
+
+const (
+	ansiReset = "\033[0m"
+	ansiBold  = "\033[1m" // ansiBold 用于突出显示提及自己的消息；
+)
+
+func init() {
+	registerCommand(&command{
+		name:    "nick",
+		usage:   "/nick <name>",
+		desc:    "设置自己的昵称",
+		handler: cmdNick,
+	})
+	registerCommand(&command{
+		name:    "nickcolor",
+		usage:   "/nickcolor <color|none>",
+		desc:    "设置昵称显示颜色，可选：red green yellow blue magenta cyan white",
+		handler: cmdNickColor,
+	})
+	registerCommand(&command{
+		name:    "findnick",
+		usage:   "/findnick <prefix>",
+		desc:    "按前缀查找在线用户的昵称（不区分大小写）",
+		handler: cmdFindNick,
+	})
+}
+
+// displayName 返回用户的昵称，没有设置昵称时返回 ID，只能在 broadcaster 中调用
+func (u *User) displayName() string {
+	if u.Nick != "" {
+		return u.Nick
+	}
+	return strconv.Itoa(u.ID)
+}
+
+// label 返回消息前面展示的用户名，设置了昵称颜色或开启了 -color 时带上 ANSI 颜色，只能在 broadcaster 中调用
+func (u *User) label() string {
+	if code, ok := nickColors[u.NickColor]; ok {
+		return code + u.displayName() + ansiReset
+	}
+	if *colorIDs {
+		return idColors[u.ID%len(idColors)] + u.displayName() + ansiReset
+	}
+	return u.displayName()
+}
+
+// validateNick 检查昵称是否合法：非空、不超长、不含空白和控制字符，且不能是纯数字，以免和用户 ID 混淆
+func validateNick(nick string) error {
+	if nick == "" {
+		return errors.New("usage: /nick <name>")
+	}
+	if len([]rune(nick)) > maxNickLen {
+		return errors.New("nickname is too long, max " + strconv.Itoa(maxNickLen) + " characters")
+	}
+	for _, r := range nick {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return errors.New("nickname must not contain spaces or control characters")
+		}
+	}
+	if _, err := strconv.Atoi(nick); err == nil {
+		return errors.New("nickname must not be a number")
+	}
+	return nil
+}
+
+func cmdNick(user *User, args string) {
+	if err := validateNick(args); err != nil {
+		replyError(user, "nick", err.Error())
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		key := strings.ToLower(args)
+		if other, ok := s.nicks[key]; ok && other != user {
+			s.fail(user, "nick", "nickname already in use: "+args)
+			return
+		}
+
+		now := time.Now()
+		if wait, ok := s.checkReservedNick(user, key, now); !ok {
+			s.fail(user, "nick", reservedNickError(args, wait))
+			return
+		}
+
+		// 频繁换昵称会刷屏，也可以用来躲避屏蔽
+		if !user.nickChangedAt.IsZero() && now.Sub(user.nickChangedAt) < *nickInterval {
+			s.fail(user, "nick", "you are changing your nickname too often")
+			return
+		}
+
+		old := user.displayName()
+		if user.Nick != "" {
+			delete(s.nicks, strings.ToLower(user.Nick))
+		}
+		user.Nick = args
+		user.nickChangedAt = now
+		s.nicks[key] = user
+		s.broadcast(&Message{Content: "user:`" + old + "` is now known as `" + args + "`"})
+		s.deliverInbox(user)
+	}
+}
+
+// cmdNickColor 设置昵称颜色，颜色以 ANSI 转义序列的形式附在消息中，由带 -color 的客户端渲染
+func cmdNickColor(user *User, args string) {
+	color := strings.ToLower(args)
+	if color == "none" {
+		color = ""
+	} else if _, ok := nickColors[color]; !ok {
+		replyError(user, "nickcolor", "usage: /nickcolor <red|green|yellow|blue|magenta|cyan|white|none>")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		user.NickColor = color
+		if color == "" {
+			s.send(user, "nickname color cleared")
+			return
+		}
+		s.send(user, "nickname color set to "+user.label())
+	}
+}
+
+// cmdFindNick 在昵称表中查找以 prefix 开头的昵称，按昵称排序，最多返回 maxFindNick 条
+func cmdFindNick(user *User, args string) {
+	if args == "" {
+		replyError(user, "findnick", "usage: /findnick <prefix>")
+		return
+	}
+	prefix := strings.ToLower(args)
+
+	actionChannel <- func(s *chatState) {
+		var keys []string
+		for key := range s.nicks {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			s.send(user, "no nicknames start with "+args)
+			return
+		}
+		sort.Strings(keys)
+
+		lines := []string{strconv.Itoa(len(keys)) + " nicknames start with " + args + ":"}
+		for i, key := range keys {
+			if i == maxFindNick {
+				lines = append(lines, "  ... and "+strconv.Itoa(len(keys)-maxFindNick)+" more")
+				break
+			}
+			u := s.nicks[key]
+			lines = append(lines, "  "+u.Nick+" (id "+strconv.Itoa(u.ID)+", "+u.Room+")")
+		}
+		s.send(user, strings.Join(lines, "\n"))
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var nickGrace = flag.Duration("nick-grace", 0, "用户断开后为其昵称保留的时长，期间只有来自同一 IP 的连接可以重新使用该昵称，0 表示断开后立即释放")
+
+// nickReservation 是断开的用户留下的昵称保留
+type nickReservation struct {
+	host  string    // host 是原用户的 IP，UNIX socket 等没有 IP 的连接为其地址；
+	until time.Time // until 是保留的截止时间；
+}
+
+// reserveNick 在用户离开时保留其昵称，只能在 broadcaster 中调用；被管理员踢出的用户不保留
+// 目前没有会话令牌，重连的用户只能按 IP 认出
+func (s *chatState) reserveNick(user *User, now time.Time) {
+	if *nickGrace <= 0 || user.Nick == "" || user.kicked.Load() {
+		return
+	}
+	s.reservedNicks[strings.ToLower(user.Nick)] = nickReservation{host: remoteHost(user.Addr), until: now.Add(*nickGrace)}
+}
+
+// checkReservedNick 检查用户能否使用被保留的昵称，不能时返回还要等待的时间；同一 IP 的用户取回昵称后保留随之解除
+func (s *chatState) checkReservedNick(user *User, key string, now time.Time) (time.Duration, bool) {
+	r, ok := s.reservedNicks[key]
+	if !ok || !now.Before(r.until) {
+		return 0, true
+	}
+	if r.host != remoteHost(user.Addr) {
+		return r.until.Sub(now), false
+	}
+	delete(s.reservedNicks, key)
+	return 0, true
+}
+
+// pruneReservedNicks 丢弃已经过期的昵称保留
+func (s *chatState) pruneReservedNicks(now time.Time) {
+	for key, r := range s.reservedNicks {
+		if !now.Before(r.until) {
+			delete(s.reservedNicks, key)
+		}
+	}
+}
+
+// reservedNickError 是昵称被保留时的错误说明
+func reservedNickError(nick string, wait time.Duration) string {
+	return "nickname " + nick + " is reserved for a reconnecting user, try again in " + strconv.Itoa(int(wait.Seconds())+1) + "s"
+}
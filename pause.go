@@ -0,0 +1,43 @@
+package main
+
+import "strconv"
+
+func init() {
+	registerCommand(&command{
+		name:    "pause",
+		usage:   "/pause",
+		desc:    "暂停接收房间消息，期间的消息直接丢弃",
+		handler: cmdPause,
+	})
+	registerCommand(&command{
+		name:    "resume",
+		usage:   "/resume",
+		desc:    "恢复接收房间消息，并显示暂停期间错过的消息数",
+		handler: cmdResume,
+	})
+}
+
+// cmdPause 暂停接收广播，和免打扰不同，暂停期间提及自己的消息也不会送达
+// 错过的消息不会缓存，需要时可以用 /history 查看
+func cmdPause(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		if user.paused {
+			s.fail(user, "pause", "already paused")
+			return
+		}
+		user.paused = true
+		user.missed = 0
+		s.send(user, "paused, type /resume to receive messages again")
+	}
+}
+
+func cmdResume(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		if !user.paused {
+			s.fail(user, "resume", "not paused")
+			return
+		}
+		user.paused = false
+		s.send(user, "resumed, missed "+strconv.Itoa(user.missed)+" messages while paused")
+	}
+}
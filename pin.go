@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		name:    "pin",
+		usage:   "/pin <seq>",
+		desc:    "房主或管理员把当前房间的一条最近消息设为置顶，每个房间只有一条置顶",
+		handler: cmdPin,
+	})
+	registerCommand(&command{
+		name:    "unpin",
+		usage:   "/unpin",
+		desc:    "房主或管理员取消当前房间的置顶",
+		handler: cmdUnpin,
+	})
+	registerCommand(&command{
+		name:    "pinned",
+		usage:   "/pinned",
+		desc:    "查看当前房间的置顶消息",
+		handler: cmdPinned,
+	})
+}
+
+// sendPinned 把当前房间的置顶消息私下发给用户，没有置顶时返回 false，只能在 broadcaster 中调用
+// 置顶保存的是最近消息中的同一条 Message，消息被编辑后置顶也随之更新
+func (s *chatState) sendPinned(user *User) bool {
+	r := s.rooms[user.Room]
+	if r == nil || r.pinned == nil {
+		return false
+	}
+	s.send(user, "--- pinned in room "+r.name+" ---\n"+formatFor(user, r.pinned))
+	return true
+}
+
+// unpinExpired 在阅后即焚的置顶消息过期后取消置顶，在 pruneHistory 中调用
+func (r *room) unpinExpired(now time.Time) {
+	if r.pinned != nil && !r.pinned.Expires.IsZero() && !now.Before(r.pinned.Expires) {
+		r.pinned = nil
+	}
+}
+
+func cmdPin(user *User, args string) {
+	seq, err := strconv.Atoi(args)
+	if err != nil {
+		replyError(user, "pin", "usage: /pin <seq>")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		r := s.rooms[user.Room]
+		if r.owner != user && !s.isAdmin(user) {
+			s.fail(user, "pin", "only the room owner or an admin can pin messages")
+			return
+		}
+		// 只能置顶本房间仍在最近消息中的消息
+		found, i := s.findHistory(seq)
+		if i < 0 || found != r {
+			s.fail(user, "pin", "no recent message #"+args+" in room "+r.name)
+			return
+		}
+		r.pinned = r.history[i]
+		s.broadcast(&Message{Room: r.name, Content: "user:`" + user.displayName() + "` pinned #" + args})
+	}
+}
+
+func cmdUnpin(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		r := s.rooms[user.Room]
+		if r.owner != user && !s.isAdmin(user) {
+			s.fail(user, "unpin", "only the room owner or an admin can unpin messages")
+			return
+		}
+		if r.pinned == nil {
+			s.fail(user, "unpin", "no pinned message in room "+r.name)
+			return
+		}
+		r.pinned = nil
+		s.broadcast(&Message{Room: r.name, Content: "user:`" + user.displayName() + "` unpinned the message"})
+	}
+}
+
+func cmdPinned(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		if !s.sendPinned(user) {
+			s.send(user, "no pinned message in room "+user.Room)
+		}
+	}
+}
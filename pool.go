@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+)
+
+// 默认每个连接一个 goroutine，连接数不受限制，新连接马上就能得到处理；
+// 开启 -conn-workers 后由固定数量的 worker 处理连接，一个 worker 负责一个连接直到断开，
+// 因此 worker 数就是同时在线连接数的上限：goroutine 数量有了上界，代价是 worker 都被占用时，
+// 新连接要先在 connQueue 中排队，队列满了之后 accept 循环也会停下来，由内核的 backlog 暂存，用户要等到有人离开才能得到响应
+var (
+	connWorkers = flag.Int("conn-workers", 0, "处理连接的 worker 数，即同时处理的连接数上限，0 表示每个连接单独一个 goroutine，不限制")
+	connBacklog = flag.Int("conn-queue", 64, "开启 -conn-workers 时，等待空闲 worker 的连接队列长度，队列满时暂停接受新连接")
+)
+
+// connJob 是一个等待 worker 处理的连接
+type connJob struct {
+	conn    net.Conn
+	release func()
+	done    func() // done 在 handleConn 返回后调用，见 trackConn；
+}
+
+// connQueue 是等待 worker 处理的连接，由 startConnWorkers 创建，为 nil 表示不使用 worker
+var connQueue chan connJob
+
+// startConnWorkers 按 -conn-workers 启动处理连接的 worker，未开启时什么也不做
+func startConnWorkers() {
+	if *connWorkers <= 0 {
+		return
+	}
+	connQueue = make(chan connJob, *connBacklog)
+	for i := 0; i < *connWorkers; i++ {
+		go func() {
+			for job := range connQueue {
+				handleConn(job.conn, job.release)
+				job.done()
+			}
+		}()
+	}
+}
+
+// serveConn 把新连接交给 handleConn 处理：没有开启 worker 时新开一个 goroutine，
+// 否则放入 connQueue，队列满时阻塞调用方（accept 循环或 WebSocket 握手），直到有 worker 空出来
+func serveConn(conn net.Conn, release func()) {
+	done := trackConn(conn)
+	if connQueue == nil {
+		go func() {
+			defer done()
+			handleConn(conn, release)
+		}()
+		return
+	}
+	job := connJob{conn: conn, release: release, done: done}
+	select {
+	case connQueue <- job:
+	default:
+		log.Printf("所有 %d 个 worker 都在处理连接，等待队列已满，暂停接受新连接", *connWorkers)
+		connQueue <- job
+	}
+}
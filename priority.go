@@ -0,0 +1,50 @@
+package main
+
+import "time"
+
+// 消息优先级：高优先级的消息（如管理员公告）走每个用户单独的 priorityChannel，
+// 写 goroutine 每次发送前先发完排队的高优先级消息，因此即使用户的 MessageChannel 积压，公告也能尽快送达
+const (
+	priorityNormal = iota
+	priorityHigh
+)
+
+func init() {
+	registerCommand(&command{
+		name:      "announce",
+		usage:     "/announce <text>",
+		desc:      "向所有在线用户发送优先送达的公告",
+		adminOnly: true,
+		handler:   cmdAnnounce,
+	})
+}
+
+// sendPriority 和 send 一样不会阻塞，只是投递到高优先级通道
+func (s *chatState) sendPriority(user *User, text string) {
+	select {
+	case user.priorityChannel <- text:
+		user.delivered()
+	default:
+		user.undelivered()
+	}
+}
+
+// closeChannels 关闭用户的两个消息通道，写 goroutine 发完剩余的消息后退出
+func (u *User) closeChannels() {
+	close(u.priorityChannel)
+	close(u.MessageChannel)
+}
+
+func cmdAnnounce(user *User, args string) {
+	if args == "" {
+		replyError(user, "announce", "usage: /announce <text>")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "announce") {
+			return
+		}
+		s.broadcast(&Message{Content: "[announcement from " + user.displayName() + "] " + args, Time: time.Now(), Priority: priorityHigh})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// MessageChannel 积压时，高优先级消息排在所有普通消息之前写出
+func TestPriorityJumpsQueue(t *testing.T) {
+	user := &User{ID: 1, MessageChannel: make(chan string, 8), priorityChannel: make(chan string, 4)}
+	s := newChatState()
+	defer s.close()
+	for i := 0; i < cap(user.MessageChannel); i++ {
+		s.send(user, "normal "+strconv.Itoa(i))
+	}
+	s.send(user, "dropped")
+	s.sendPriority(user, "urgent")
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go sendMessage(server, user.MessageChannel, user.priorityChannel)
+
+	input := bufio.NewScanner(client)
+	want := []string{"urgent"}
+	for i := 0; i < cap(user.MessageChannel); i++ {
+		want = append(want, "normal "+strconv.Itoa(i))
+	}
+	for _, w := range want {
+		if !input.Scan() {
+			t.Fatalf("connection closed before %q: %v", w, input.Err())
+		}
+		if got := input.Text(); got != w {
+			t.Fatalf("got %q, want %q", got, w)
+		}
+	}
+	user.closeChannels()
+}
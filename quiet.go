@@ -0,0 +1,32 @@
+package main
+
+func init() {
+	registerCommand(&command{
+		name:    "quiet",
+		usage:   "/quiet",
+		desc:    "不再接收进入、离开等系统提醒，只影响自己",
+		handler: cmdQuiet,
+	})
+	registerCommand(&command{
+		name:    "loud",
+		usage:   "/loud",
+		desc:    "恢复接收系统提醒",
+		handler: cmdLoud,
+	})
+}
+
+// cmdQuiet 屏蔽发给自己的系统提醒（没有发送者的广播，如进入、离开、改名、房主变更），
+// 管理员公告是高优先级消息，总是会送达；和全局的 -quiet-joins 不同，只影响执行命令的用户
+func cmdQuiet(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		user.quiet = true
+		s.send(user, "system notices are now hidden, type /loud to show them again")
+	}
+}
+
+func cmdLoud(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		user.quiet = false
+		s.send(user, "system notices are shown again")
+	}
+}
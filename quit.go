@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+// 告别语最大长度（按字符计算）
+const maxQuitLen = 64
+
+func init() {
+	registerCommand(&command{
+		name:    "quit",
+		usage:   "/quit [message]",
+		desc:    "离开聊天室，可以留下一句告别语，显示在离开提醒中",
+		handler: cmdQuit,
+	})
+}
+
+// cmdQuit 记录告别语并让 handleConn 结束读循环，之后和断开连接一样经由 leavingChannel 注销
+func cmdQuit(user *User, args string) {
+	msg := stripControl(args)
+	if utf8.RuneCountInString(msg) > maxQuitLen {
+		replyError(user, "quit", "quit message is too long, max "+strconv.Itoa(maxQuitLen)+" characters")
+		return
+	}
+	user.quitMessage = msg
+	user.quitting = true
+	user.MessageChannel <- "bye"
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"time"
+)
+
+var byteQuota = flag.Int64("byte-quota", 0, "每个连接收发字节数之和的上限，超过后断开连接，0 表示不限制")
+
+// meteredConn 统计写给用户的字节数，供 /mystats 和 -byte-quota 使用，只在该用户的写 goroutine 中使用
+type meteredConn struct {
+	net.Conn
+	user *User
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.user.bytesOut.Add(int64(n))
+	checkQuota(c.user, c.Conn)
+	return n, err
+}
+
+// checkQuota 在用户的收发字节数超过 -byte-quota 时做上标记，并让阻塞中的读操作立即返回，由 handleConn 断开连接
+func checkQuota(user *User, conn net.Conn) bool {
+	if *byteQuota <= 0 || user.bytesIn.Load()+user.bytesOut.Load() <= *byteQuota {
+		return false
+	}
+	user.overQuota.Store(true)
+	conn.SetReadDeadline(time.Now())
+	return true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxReactionLen 是单个表情回应允许的最大字符数，组合表情由多个码点组成，因此不限制为一个字符
+const maxReactionLen = 8
+
+func init() {
+	registerCommand(&command{
+		name:    "react",
+		usage:   "/react <seq> <emoji>",
+		desc:    "对当前房间的最近消息添加表情回应",
+		handler: cmdReact,
+	})
+}
+
+// cmdReact 对最近消息缓冲区中的消息添加表情回应，每个用户对同一条消息的同一个表情只计一次
+func cmdReact(user *User, args string) {
+	seqArg, emoji, _ := strings.Cut(args, " ")
+	seq, err := strconv.Atoi(strings.TrimPrefix(seqArg, "#"))
+	emoji = strings.TrimSpace(emoji)
+	if err != nil || emoji == "" || strings.ContainsAny(emoji, " \t") || utf8.RuneCountInString(emoji) > maxReactionLen {
+		replyError(user, "react", "usage: /react <seq> <emoji>")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		r, i := s.findHistory(seq)
+		if i < 0 || r.name != user.Room {
+			s.fail(user, "react", "no recent message #"+strconv.Itoa(seq)+" in room "+user.Room)
+			return
+		}
+		orig := r.history[i]
+		if orig.Reactions == nil {
+			orig.Reactions = make(map[string]map[int]struct{})
+		}
+		if orig.Reactions[emoji] == nil {
+			orig.Reactions[emoji] = make(map[int]struct{})
+		}
+		if _, ok := orig.Reactions[emoji][user.ID]; ok {
+			s.fail(user, "react", "you already reacted "+emoji+" to #"+strconv.Itoa(seq))
+			return
+		}
+		orig.Reactions[emoji][user.ID] = struct{}{}
+		s.broadcast(&Message{Kind: kindReaction, From: user, Room: orig.Room, Seq: orig.Seq, Content: emoji, Reactions: orig.Reactions})
+	}
+}
+
+// formatReactions 把表情回应汇总成 "👍 2, ❤ 1" 的形式，按次数从多到少排列
+func formatReactions(reactions map[string]map[int]struct{}) string {
+	emojis := make([]string, 0, len(reactions))
+	for emoji := range reactions {
+		emojis = append(emojis, emoji)
+	}
+	sort.Slice(emojis, func(i, j int) bool {
+		if ni, nj := len(reactions[emojis[i]]), len(reactions[emojis[j]]); ni != nj {
+			return ni > nj
+		}
+		return emojis[i] < emojis[j]
+	})
+
+	parts := make([]string, len(emojis))
+	for i, emoji := range emojis {
+		parts[i] = emoji + " " + strconv.Itoa(len(reactions[emoji]))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var recentDepartures = flag.Int("recent", 10, "/recent 显示的最近离开的用户数，0 表示不记录")
+
+// departure 是一条用户离开的记录
+type departure struct {
+	id      int
+	nick    string
+	at      time.Time
+	message string // message 是 /quit 留下的告别语；
+}
+
+func init() {
+	registerCommand(&command{
+		name:    "recent",
+		usage:   "/recent",
+		desc:    "查看最近离开的用户",
+		handler: cmdRecent,
+	})
+}
+
+// recordDeparture 在用户离开时记录，超出 -recent 条时丢弃最早的记录
+func (s *chatState) recordDeparture(user *User, now time.Time) {
+	if *recentDepartures <= 0 {
+		return
+	}
+	s.departed = append(s.departed, departure{id: user.ID, nick: user.Nick, at: now, message: user.quitMessage})
+	if over := len(s.departed) - *recentDepartures; over > 0 {
+		s.departed = s.departed[over:]
+	}
+}
+
+// cmdRecent 从新到旧列出最近离开的用户以及离开了多久
+func cmdRecent(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		if len(s.departed) == 0 {
+			s.send(user, "nobody has left recently")
+			return
+		}
+
+		now := time.Now()
+		lines := []string{"recently left:"}
+		for i := len(s.departed) - 1; i >= 0; i-- {
+			d := s.departed[i]
+			line := "  " + strconv.Itoa(d.id)
+			if d.nick != "" {
+				line += " " + d.nick
+			}
+			line += " (" + now.Sub(d.at).Round(time.Second).String() + " ago"
+			if d.message != "" {
+				line += ", " + d.message
+			}
+			lines = append(lines, line+")")
+		}
+		s.send(user, strings.Join(lines, "\n"))
+	}
+}
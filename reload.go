@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var configFile = flag.String("config", "", "配置文件，每行一个 <参数名>=<值>，# 开头为注释；启动时读取，命令行指定的参数优先；收到 SIGHUP 时重新读取其中可以在运行时修改的参数")
+
+// reloadable 是收到 SIGHUP 时可以从配置文件重新读取的参数
+// 这些参数大多只在 broadcaster 中读取（或者像 -client-send-timeout 那样只在 broadcaster 等待的 fanout worker 中读取），
+// 因此由 broadcaster 修改即可保证并发安全；频率限制和 -max-line 在 handleConn 中读取，通过 connLimits 快照发布；
+// 其余参数（监听地址等）只能重启后生效
+var reloadable = map[string]bool{
+	"burst":                true,
+	"client-send-timeout":  true,
+	"color":                true,
+	"flood-mute":           true,
+	"flood-violations":     true,
+	"flood-window":         true,
+	"history-replay":       true,
+	"history-replay-bytes": true,
+	"max-line":             true,
+	"max-rooms":            true,
+	"max-scheduled":        true,
+	"max-users":            true,
+	"message-template":     true,
+	"nick-grace":           true,
+	"nick-interval":        true,
+	"offline-inbox-ttl":    true,
+	"queue":                true,
+	"quiet-joins":          true,
+	"rate":                 true,
+	"recent":               true,
+	"search-results":       true,
+	"typing-debounce":      true,
+	"typing-expire":        true,
+}
+
+// connLimits 是 handleConn 中读取、可以在运行时修改的参数的快照
+// broadcaster 修改参数后整体替换快照，handleConn 每读一行取一次，不会读到一部分新、一部分旧的取值
+type connLimits struct {
+	rate            float64
+	burst           int
+	floodViolations int
+	floodWindow     time.Duration
+	floodMute       time.Duration
+	maxLine         int // maxLine 对已经建立的连接只能收紧，放宽后只对新连接生效，见 handleConn；
+}
+
+// limits 是当前生效的 connLimits，由 storeLimits 设置
+var limits atomic.Pointer[connLimits]
+
+// storeLimits 按当前的参数生成 connLimits 快照，在 setup 中和重新读取配置之后调用
+func storeLimits() {
+	limits.Store(&connLimits{
+		rate:            *rateLimit,
+		burst:           *rateBurst,
+		floodViolations: *floodViolations,
+		floodWindow:     *floodWindow,
+		floodMute:       *floodMute,
+		maxLine:         *maxLineSize,
+	})
+}
+
+// cmdlineFlags 是命令行中显式指定的参数，配置文件不会覆盖它们
+var cmdlineFlags = make(map[string]bool)
+
+// readConfigFile 读取配置文件，返回按出现顺序排列的参数名和值，参数名可以带前缀 -
+func readConfigFile(path string) ([][2]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var settings [][2]string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimLeft(strings.TrimSpace(name), "-")
+		if !ok || name == "" {
+			return nil, errors.New(path + ":" + strconv.Itoa(n) + ": expected <name>=<value>")
+		}
+		if flag.Lookup(name) == nil {
+			return nil, errors.New(path + ":" + strconv.Itoa(n) + ": unknown flag -" + name)
+		}
+		settings = append(settings, [2]string{name, strings.TrimSpace(value)})
+	}
+	return settings, scanner.Err()
+}
+
+// loadConfigFile 在 flag.Parse 之后、setup 之前调用，把配置文件中命令行没有指定的参数设置好
+func loadConfigFile() error {
+	flag.Visit(func(f *flag.Flag) { cmdlineFlags[f.Name] = true })
+	if *configFile == "" {
+		return nil
+	}
+	settings, err := readConfigFile(*configFile)
+	if err != nil {
+		return err
+	}
+	for _, kv := range settings {
+		if cmdlineFlags[kv[0]] {
+			continue
+		}
+		if err := flag.Set(kv[0], kv[1]); err != nil {
+			return errors.New(*configFile + ": -" + kv[0] + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// reloadConfig 重新读取配置文件，可以在运行时修改的参数交给 broadcaster 设置，其余取值有变化的参数记录警告后忽略
+// 新的取值通不过检查时全部恢复原值，配置要么整体生效，要么不生效
+func reloadConfig() {
+	settings, err := readConfigFile(*configFile)
+	if err != nil {
+		log.Println("重新读取配置文件失败：", err)
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		var err error
+		old := make(map[string]string)
+		for _, kv := range settings {
+			name, value := kv[0], kv[1]
+			f := flag.Lookup(name)
+			if cmdlineFlags[name] || f.Value.String() == value {
+				continue
+			}
+			if !reloadable[name] {
+				log.Printf("参数 -%s 需要重启才能生效，已忽略", name)
+				continue
+			}
+			if _, ok := old[name]; !ok {
+				old[name] = f.Value.String()
+			}
+			if err = f.Value.Set(value); err != nil {
+				err = errors.New("-" + name + ": " + err.Error())
+				break
+			}
+		}
+		if err == nil {
+			err = validateFlags()
+		}
+		if _, ok := old["message-template"]; ok && err == nil {
+			err = parseMessageTemplate()
+		}
+		if err != nil {
+			for name, value := range old {
+				flag.Lookup(name).Value.Set(value)
+			}
+			log.Println("配置文件有误，保持原有配置：", err)
+			return
+		}
+		storeLimits()
+		for name := range old {
+			log.Printf("参数 -%s 已修改为 %s", name, flag.Lookup(name).Value.String())
+		}
+	}
+}
+
+// handleHangup 收到 SIGHUP 时重新打开日志文件、重新读取配置文件，配置了 -log-file 或 -config 时才由 main 启动
+func handleHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if serverLog != nil {
+			if err := serverLog.reopen(); err != nil {
+				log.Println("重新打开日志文件失败：", err)
+			} else {
+				log.Println("已重新打开日志文件")
+			}
+		}
+		if *configFile != "" {
+			reloadConfig()
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// SIGHUP 重新读取配置后，新的频率限制对已经连上的客户端立即生效
+func TestReloadRateLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chatroom.conf")
+	var configBefore string
+	inBroadcaster(func(*chatState) {
+		configBefore, *configFile = *configFile, path
+	})
+	defer inBroadcaster(func(*chatState) {
+		*configFile = configBefore
+		for _, name := range []string{"rate", "burst", "flood-violations"} {
+			f := flag.Lookup(name)
+			f.Value.Set(f.DefValue)
+		}
+		storeLimits()
+	})
+
+	c := dial(t)
+	defer c.close(t)
+	c.sync(t, t.Name())
+	for i := 0; i < 3; i++ {
+		c.send(t, t.Name()+" before")
+		c.expect(t, ": "+t.Name()+" before")
+	}
+
+	// reloadConfig 就是收到 SIGHUP 时执行的操作
+	if err := os.WriteFile(path, []byte("rate=0.001\nburst=1\nflood-violations=0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig()
+	c.sync(t, t.Name())
+
+	c.send(t, t.Name()+" first")
+	c.expect(t, ": "+t.Name()+" first")
+	c.send(t, t.Name()+" second")
+	c.expect(t, "rate limit exceeded")
+}
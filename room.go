@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// 新用户默认所在的房间，大厅不能设为私有，也不会被删除
+const lobbyRoom = "lobby"
+
+// 房间名最大长度（按字符计算）
+const maxRoomNameLen = 32
+
+var maxRooms = flag.Int("max-rooms", 0, "除大厅外最多同时存在的房间数，达到上限后 /join 不能再创建新房间，0 表示不限制；房间没人后会被删除，不计入上限")
+
+// room 是一个聊天房间，只能在 broadcaster goroutine 中访问
+type room struct {
+	name    string             // name 是房间名；
+	owner   *User              // owner 是房间创建者，为 nil 表示无主（如大厅）；
+	private bool               // private 为 true 时，只有受邀用户才能加入；
+	invited map[int]struct{}   // invited 是受邀用户的 ID；
+	members map[*User]struct{} // members 是房间内的在线用户；
+	limit   int                // limit 是房间的人数上限，0 表示不限制，见 /roomlimit；
+
+	slowmode time.Duration       // slowmode 是慢速模式下同一用户两次发言的最小间隔，0 表示关闭；
+	lastPost map[*User]time.Time // lastPost 是慢速模式下每个用户最近一次发言的时间；
+
+	typing      map[*User]struct{} // typing 是房间内正在输入的用户，见 typing.go；
+	typingDirty bool               // typingDirty 表示输入状态有变化，还没有发出提示；
+	typingEmit  time.Time          // typingEmit 是最近一次发出输入提示的时间；
+
+	history []*Message // history 是房间的最近消息，按序号从小到大排列，房间删除时一起丢弃；
+	pinned  *Message   // pinned 是房间的置顶消息，是 history 中的一条，被删除或过期时取消，见 pin.go；
+}
+
+func init() {
+	registerCommand(&command{
+		name:    "join",
+		usage:   "/join <room>",
+		desc:    "加入房间，房间不存在时自动创建",
+		aliases: []string{"j"},
+		handler: cmdJoin,
+	})
+	registerCommand(&command{
+		name:    "rooms",
+		usage:   "/rooms",
+		desc:    "列出所有房间",
+		handler: cmdRooms,
+	})
+	registerCommand(&command{
+		name:    "myrooms",
+		usage:   "/myrooms",
+		desc:    "列出自己所在的房间",
+		handler: cmdMyRooms,
+	})
+	registerCommand(&command{
+		name:    "private",
+		usage:   "/private [on|off]",
+		desc:    "房主将当前房间设为私有或公开",
+		handler: cmdPrivate,
+	})
+	registerCommand(&command{
+		name:    "invite",
+		usage:   "/invite <id>",
+		desc:    "邀请用户加入当前的私有房间",
+		handler: cmdInvite,
+	})
+	registerCommand(&command{
+		name:    "roomlimit",
+		usage:   "/roomlimit <n>",
+		desc:    "房主或管理员设置当前房间的人数上限，0 表示不限制",
+		handler: cmdRoomLimit,
+	})
+	registerCommand(&command{
+		name:      "slowmode",
+		usage:     "/slowmode <seconds>",
+		desc:      "设置当前房间的慢速模式，0 表示关闭",
+		adminOnly: true,
+		handler:   cmdSlowmode,
+	})
+}
+
+// validateRoomName 检查房间名是否合法：非空、不超长、不含空白和控制字符
+func validateRoomName(name string) error {
+	if name == "" {
+		return errors.New("usage: /join <room>")
+	}
+	if len([]rune(name)) > maxRoomNameLen {
+		return errors.New("room name is too long, max " + strconv.Itoa(maxRoomNameLen) + " characters")
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return errors.New("room name must not contain spaces or control characters")
+		}
+	}
+	return nil
+}
+
+// canJoin 判断用户是否允许进入房间，私有房间只允许房主和受邀用户进入
+func (r *room) canJoin(user *User) bool {
+	if !r.private || r.owner == user {
+		return true
+	}
+	_, ok := r.invited[user.ID]
+	return ok
+}
+
+// joinRoom 把用户移动到指定房间，房间不存在时创建，并由该用户成为房主
+func (s *chatState) joinRoom(user *User, name string) {
+	r, ok := s.rooms[name]
+	if !ok {
+		r = &room{
+			name:     name,
+			invited:  make(map[int]struct{}),
+			members:  make(map[*User]struct{}),
+			lastPost: make(map[*User]time.Time),
+			typing:   make(map[*User]struct{}),
+		}
+		if name != lobbyRoom {
+			r.owner = user
+		}
+		s.rooms[name] = r
+	}
+
+	s.leaveRoom(user)
+	r.members[user] = struct{}{}
+	user.Room = name
+}
+
+// leaveRoom 让用户离开当前房间
+// 房主离开时，房间转交给在线时间最长的成员；房间没人时删除（大厅除外），房间的私有设置也随之失效
+func (s *chatState) leaveRoom(user *User) {
+	r, ok := s.rooms[user.Room]
+	if !ok {
+		return
+	}
+	delete(r.members, user)
+	delete(r.lastPost, user)
+	user.Room = ""
+	user.typingSeen = ""
+	if _, ok := r.typing[user]; ok {
+		delete(r.typing, user)
+		r.typingDirty = true
+	}
+
+	if len(r.members) == 0 {
+		if r.name != lobbyRoom {
+			delete(s.rooms, r.name)
+			s.stats.dropRoom(r.name)
+		}
+		return
+	}
+
+	if r.owner == user {
+		r.owner = longestConnected(r.members)
+		s.broadcast(&Message{Room: r.name, Content: "user:`" + r.owner.displayName() + "` is now the owner of room " + r.name})
+	}
+	s.flushTyping(r, time.Now())
+}
+
+// roomLimitReached 判断是否已经不能再创建新房间，大厅总是存在，不计入 -max-rooms
+func (s *chatState) roomLimitReached() bool {
+	if *maxRooms <= 0 {
+		return false
+	}
+	n := len(s.rooms)
+	if _, ok := s.rooms[lobbyRoom]; ok {
+		n--
+	}
+	return n >= *maxRooms
+}
+
+// longestConnected 返回进入聊天室最早的用户
+func longestConnected(users map[*User]struct{}) *User {
+	var oldest *User
+	for user := range users {
+		if oldest == nil || user.EnterAt.Before(oldest.EnterAt) {
+			oldest = user
+		}
+	}
+	return oldest
+}
+
+func cmdJoin(user *User, args string) {
+	if err := validateRoomName(args); err != nil {
+		replyError(user, "join", err.Error())
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		if user.Room == args {
+			s.fail(user, "join", "you are already in room "+args)
+			return
+		}
+		r, ok := s.rooms[args]
+		if ok && !r.canJoin(user) {
+			s.fail(user, "join", "room "+args+" is private, you need an invitation")
+			return
+		}
+		if ok && r.limit > 0 && len(r.members) >= r.limit {
+			s.fail(user, "join", "room is full")
+			return
+		}
+		if !ok && s.roomLimitReached() {
+			s.fail(user, "join", "room limit reached")
+			return
+		}
+		old := user.Room
+		s.joinRoom(user, args)
+		s.broadcast(&Message{Room: old, Content: "user:`" + user.displayName() + "` left room " + old})
+		s.broadcast(&Message{Room: args, Content: "user:`" + user.displayName() + "` joined room " + args})
+		s.replayHistory(user)
+		s.sendPinned(user)
+	}
+}
+
+func cmdRooms(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		names := make([]string, 0, len(s.rooms))
+		for name := range s.rooms {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		lines := make([]string, 0, len(names))
+		for _, name := range names {
+			r := s.rooms[name]
+			line := name + " (" + strconv.Itoa(len(r.members)) + " users"
+			if r.limit > 0 {
+				line += ", max " + strconv.Itoa(r.limit)
+			}
+			line += ")"
+			if r.private {
+				line += " [private]"
+			}
+			lines = append(lines, line)
+		}
+		s.send(user, "rooms: "+strings.Join(lines, ", "))
+	}
+}
+
+// cmdMyRooms 从各房间的成员表中找出用户所在的房间，按房间名排序
+// 目前每个用户同时只在一个房间，因此结果就是当前房间，并附上自己是否为房主
+func cmdMyRooms(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		var lines []string
+		for name, r := range s.rooms {
+			if _, ok := r.members[user]; !ok {
+				continue
+			}
+			line := name + " (" + strconv.Itoa(len(r.members)) + " users)"
+			if r.owner == user {
+				line += " [owner]"
+			}
+			if r.private {
+				line += " [private]"
+			}
+			lines = append(lines, line)
+		}
+		sort.Strings(lines)
+		s.send(user, "your rooms: "+strings.Join(lines, ", "))
+	}
+}
+
+func cmdPrivate(user *User, args string) {
+	var private bool
+	switch args {
+	case "", "on":
+		private = true
+	case "off":
+	default:
+		replyError(user, "private", "usage: /private [on|off]")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		r := s.rooms[user.Room]
+		if r.owner != user {
+			s.fail(user, "private", "only the room owner can change its privacy")
+			return
+		}
+		r.private = private
+		if private {
+			s.broadcast(&Message{Room: r.name, Content: "room " + r.name + " is now private"})
+		} else {
+			s.broadcast(&Message{Room: r.name, Content: "room " + r.name + " is now public"})
+		}
+	}
+}
+
+// cmdInvite 邀请用户进入当前房间，私有房间的任何成员都可以邀请
+func cmdInvite(user *User, args string) {
+	id, err := strconv.Atoi(args)
+	if err != nil {
+		replyError(user, "invite", "usage: /invite <id>")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		r := s.rooms[user.Room]
+		if !r.private {
+			s.fail(user, "invite", "room "+r.name+" is public, no invitation needed")
+			return
+		}
+		r.invited[id] = struct{}{}
+		s.send(user, "invited user "+strconv.Itoa(id)+" to room "+r.name)
+		if target := s.userByID(id); target != nil {
+			s.send(target, "user:`"+user.displayName()+"` invited you to room "+r.name+", type /join "+r.name+" to enter")
+		}
+	}
+}
+
+// cmdRoomLimit 设置当前房间的人数上限，只影响之后的加入，已经在房间里的人即使超过上限也不会被移出
+func cmdRoomLimit(user *User, args string) {
+	n, err := strconv.Atoi(args)
+	if err != nil || n < 0 {
+		replyError(user, "roomlimit", "usage: /roomlimit <n>")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		r := s.rooms[user.Room]
+		if r.owner != user && !s.isAdmin(user) {
+			s.fail(user, "roomlimit", "only the room owner or an admin can change the room limit")
+			return
+		}
+		r.limit = n
+		if n == 0 {
+			s.broadcast(&Message{Room: r.name, Content: "room " + r.name + " has no member limit now"})
+			return
+		}
+		s.broadcast(&Message{Room: r.name, Content: "room " + r.name + " is now limited to " + args + " members"})
+	}
+}
+
+// allowPost 检查房间的慢速模式，允许发言时记录发言时间，否则告知用户还需等待多久
+func (s *chatState) allowPost(r *room, user *User, now time.Time) bool {
+	if r.slowmode <= 0 {
+		return true
+	}
+	if wait := r.lastPost[user].Add(r.slowmode).Sub(now); wait > 0 {
+		s.send(user, "slow mode: wait "+strconv.Itoa(int(wait.Seconds())+1)+" seconds")
+		return false
+	}
+	r.lastPost[user] = now
+	return true
+}
+
+func cmdSlowmode(user *User, args string) {
+	seconds, err := strconv.Atoi(args)
+	if err != nil || seconds < 0 {
+		replyError(user, "slowmode", "usage: /slowmode <seconds>")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "slowmode") {
+			return
+		}
+		r := s.rooms[user.Room]
+		r.slowmode = time.Duration(seconds) * time.Second
+		clear(r.lastPost)
+		if seconds == 0 {
+			s.broadcast(&Message{Room: r.name, Content: "slow mode disabled in room " + r.name})
+			return
+		}
+		s.broadcast(&Message{Room: r.name, Content: "slow mode enabled in room " + r.name + ": one message every " + args + " seconds"})
+	}
+}
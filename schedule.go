@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	maxScheduleDelay = flag.Duration("max-schedule-delay", 24*time.Hour, "/in 定时消息允许的最长延迟")
+	maxScheduled     = flag.Int("max-scheduled", 5, "每个用户最多同时等待发送的定时消息数")
+	cancelScheduled  = flag.Bool("cancel-scheduled-on-leave", false, "用户离开时取消其尚未发送的定时消息，否则到时照常发送")
+)
+
+// scheduledMessage 是一条等待发送的定时消息，由 broadcaster 在每秒的维护任务中检查，精度为 1 秒
+type scheduledMessage struct {
+	at  time.Time
+	msg *Message
+}
+
+func init() {
+	registerCommand(&command{
+		name:    "in",
+		usage:   "/in <duration> <text>",
+		desc:    "定时发送消息到当前房间，如 /in 10m stand-up time",
+		handler: cmdIn,
+	})
+}
+
+// cmdIn 安排一条定时消息，发送时间到了才分配序号，和普通消息一样受频率限制（按安排的时间计算）
+func cmdIn(user *User, args string) {
+	delayArg, text, _ := strings.Cut(args, " ")
+	delay, err := time.ParseDuration(delayArg)
+	text = normalizeSpace(strings.TrimSpace(text))
+	if err != nil || delay <= 0 || text == "" {
+		replyError(user, "in", "usage: /in <duration> <text>, e.g. /in 10m stand-up time")
+		return
+	}
+	if delay > *maxScheduleDelay {
+		replyError(user, "in", "delay is too long, max "+maxScheduleDelay.String())
+		return
+	}
+
+	now := time.Now()
+	if !allowMessage(user, now) {
+		return
+	}
+	actionChannel <- func(s *chatState) {
+		pending := 0
+		for _, sm := range s.scheduled {
+			if sm.msg.From == user {
+				pending++
+			}
+		}
+		if pending >= *maxScheduled {
+			s.fail(user, "in", "too many scheduled messages, max "+strconv.Itoa(*maxScheduled))
+			return
+		}
+
+		at := now.Add(delay)
+		s.scheduled = append(s.scheduled, &scheduledMessage{at: at, msg: &Message{From: user, Room: user.Room, Content: "[scheduled] " + text}})
+		s.send(user, "message scheduled for "+at.Format(time.TimeOnly)+" in room "+user.Room)
+	}
+}
+
+// fireScheduled 发送所有到期的定时消息；房间已经不存在时丢弃
+// 定时消息不受慢速模式限制，安排时已经检查过发言频率
+func (s *chatState) fireScheduled(now time.Time) {
+	s.scheduled = slices.DeleteFunc(s.scheduled, func(sm *scheduledMessage) bool {
+		if now.Before(sm.at) {
+			return false
+		}
+		if _, ok := s.rooms[sm.msg.Room]; ok {
+			sm.msg.Time = now
+			s.record(sm.msg)
+			s.countMessage(sm.msg)
+			s.broadcast(sm.msg)
+		}
+		return true
+	})
+}
+
+// cancelScheduledFor 在用户离开时调用，开启了 -cancel-scheduled-on-leave 时删除其尚未发送的定时消息
+func (s *chatState) cancelScheduledFor(user *User) {
+	if !*cancelScheduled {
+		return
+	}
+	s.scheduled = slices.DeleteFunc(s.scheduled, func(sm *scheduledMessage) bool {
+		return sm.msg.From == user
+	})
+}
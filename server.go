@@ -2,11 +2,21 @@ package main
 
 import (
 	"bufio"
-	"fmt"
+	"bytes"
+	"errors"
+	"flag"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -15,8 +25,101 @@ type User struct {
 	Addr           string      // Addr 是用户的 IP 地址和端口；
 	EnterAt        time.Time   // EnterAt 是用户进入时间；
 	MessageChannel chan string // MessageChannel 是当前用户发送消息的通道；
+
+	priorityChannel chan string // priorityChannel 是高优先级消息的通道，写 goroutine 优先发送，见 priority.go；
+
+	admitted      chan bool     // admitted 用于 broadcaster 告知 handleConn 是否允许进入，人数已满时需要排队等待；
+	queued        chan struct{} // queued 用于 broadcaster 告知 handleConn 已经进入等待队列；
+	briefGreeting bool          // briefGreeting 为 true 时只发送简短的欢迎信息，在登记前设置；
+	quitMessage   string        // quitMessage 是 /quit 留下的告别语，在 handleConn 中设置，发送到 leavingChannel 之后由 broadcaster 读取；
+	quitting      bool          // quitting 表示用户执行了 /quit，handleConn 读完这一行后结束读循环；
+	motdPaste     []string      // motdPaste 是 /setmotd 粘贴模式下已经输入的行，不为 nil 表示处于粘贴模式，只在 handleConn 中使用；
+	jsonInput     bool          // jsonInput 表示连接选择了 json 格式，输入也按 JSON 解析，只在 handleConn 中使用，见 format.go；
+	conn          net.Conn      // conn 是用户的连接，broadcaster 踢出用户时用它打断读循环，见 kick.go；
+
+	// 以下字段只能在 broadcaster goroutine 中读写
+	Nick      string // Nick 是用户昵称，为空时使用 ID 显示；
+	NickColor string // NickColor 是昵称的显示颜色，取值范围见 nickColors；
+	Room      string // Room 是用户当前所在的房间；
+	lastSeq   int    // lastSeq 是用户最后一条消息的序号，用于 /edit、/delete；
+	dnd       bool   // dnd 表示开启了免打扰，只接收提及自己的广播；
+	format    string // format 是广播消息的格式，为空表示文本，见 format.go；
+	paused    bool   // paused 表示用户执行了 /pause，暂不接收广播；
+	missed    int    // missed 是暂停期间丢弃的广播数，/resume 时告知用户；
+	status    string // status 是用户通过 /status 设置的个人状态；
+	quiet     bool   // quiet 表示用户执行了 /quiet，不接收系统提醒；
+	noEcho    bool   // noEcho 表示用户执行了 /echo-self off，不接收自己发出的消息；
+
+	nickChangedAt time.Time // nickChangedAt 是最近一次设置昵称的时间，用于 -nick-interval；
+	stalledSince  time.Time // stalledSince 是消息通道开始持续写满的时间，零值表示没有卡住，见 evict.go；
+
+	typingUntil time.Time // typingUntil 是输入状态的过期时间；
+	typingSeen  string    // typingSeen 是用户最近收到的输入提示，内容不变时不重复发送；
+
+	flood floodGuard // flood 记录发言频率，只在该用户的 handleConn goroutine 中使用；
+
+	// 以下计数器会被多个 goroutine 读写，因此使用原子类型，供 /mystats 使用
+	sentCount     atomic.Int64 // sentCount 是用户发出的消息数，在 broadcaster 中通过慢速模式检查后累加；
+	receivedCount atomic.Int64 // receivedCount 是成功投递给用户的消息数，在 broadcaster 中累加；
+	droppedCount  atomic.Int64 // droppedCount 是因用户接收过慢而丢弃的消息数，在 broadcaster 中累加；
+	bytesIn       atomic.Int64 // bytesIn 是从用户读取的字节数，在 handleConn 中累加；
+	bytesOut      atomic.Int64 // bytesOut 是写给用户的字节数，在写 goroutine 中累加，见 quota.go；
+	overQuota     atomic.Bool  // overQuota 表示收发字节数超过了 -byte-quota，handleConn 会断开连接；
+	kicked        atomic.Bool  // kicked 表示用户被管理员踢出，handleConn 会断开连接；
+	evicted       atomic.Bool  // evicted 表示用户长时间无法接收消息，连接已被关闭，见 evict.go；
+}
+
+// Message 是在 broadcaster 中流转的一条消息，由 broadcaster 负责格式化成文本
+type Message struct {
+	Kind    string    // Kind 是消息类型，为空表示普通消息，其余取值见 history.go；
+	Seq     int       // Seq 是用户消息的序号，由 broadcaster 分配；
+	From    *User     // From 是消息发送者，为 nil 表示系统消息；
+	Room    string    // Room 是消息所属的房间，为空表示发给所有在线用户；
+	Content string    // Content 是消息正文；
+	Time    time.Time // Time 是消息发出的时间；
+	Expires time.Time // Expires 是阅后即焚消息的过期时间，零值表示不过期；
+
+	Priority int // Priority 是消息的优先级，priorityHigh 的消息优先送达，见 priority.go；
+
+	// Reactions 是消息收到的表情回应，表情到回应者 ID 的集合，只在 broadcaster 中访问；
+	Reactions map[string]map[int]struct{}
+}
+
+// chatState 是 broadcaster 维护的聊天室状态，只能在 broadcaster goroutine 中访问
+type chatState struct {
+	users map[*User]struct{} // users 是所有在线用户；
+	nicks map[string]*User   // nicks 以小写昵称为 key 索引用户，用于保证昵称唯一；
+	rooms map[string]*room   // rooms 是所有房间，以房间名为 key；
+
+	admins map[*User]struct{} // admins 是当前的管理员；
+
+	waiting []*User // waiting 是人数已满时排队等待进入的用户，先来先进；
+
+	pool *fanoutPool // pool 是并行投递消息的 worker，没有开启时为 nil；
+
+	stats chatStats // stats 是累计的消息和连接统计；
+
+	departed []departure // departed 是最近离开的用户，按离开时间从早到晚排列，见 recent.go；
+
+	scheduled []*scheduledMessage // scheduled 是等待发送的定时消息，见 schedule.go；
+
+	inboxes     map[string][]inboxMessage // inboxes 是按小写昵称暂存的私信，见 dm.go；
+	inboxOwners map[string]inboxOwner     // inboxOwners 是按小写昵称记录的、最近带着昵称离开的用户，见 dm.go；
+
+	reservedNicks map[string]nickReservation // reservedNicks 是按小写昵称索引的、为断开的用户保留的昵称，见 nickreserve.go；
+
+	nextSeq int // nextSeq 是最近一次分配的消息序号，各房间的最近消息保存在 room.history 中；
 }
 
+var (
+	readBufferSize = flag.Int("read-buffer", 4096, "每个连接读缓冲区的初始大小（字节）")
+	maxLineSize    = flag.Int("max-line", bufio.MaxScanTokenSize, "单条消息允许的最大长度（字节），超过后断开连接")
+	quietJoins     = flag.Bool("quiet-joins", false, "不广播用户进入、离开的通知，用户仍可通过 /list 查看在线情况")
+)
+
+// startTime 是服务启动的时间，在 main 中记录，用于 /uptime
+var startTime time.Time
+
 // 定义一个 idCounter，保护 id 唯一
 var (
 	nextId    int
@@ -28,30 +131,179 @@ var (
 	enteringChannel = make(chan *User)
 	// 用户离开，通过该 channel 进行登记
 	leavingChannel = make(chan *User)
-	// 广播专用的用户普通消息 channel，缓冲是尽可能避免出现异常情况堵塞
-	messageChannel = make(chan string, 8)
+	// 广播专用的用户普通消息 channel，缓冲是尽可能避免出现异常情况堵塞，长度由 -message-queue 指定，在 main 中创建
+	messageChannel chan *Message
+	// 需要读写 broadcaster 内部状态的操作，通过该 channel 交给 broadcaster 串行执行，避免用锁
+	actionChannel = make(chan func(s *chatState))
 )
 
 func main() {
-	// 只绑定在 127.0.0.1 上：net.Listen(“tcp”, “127.0.0.1:2020”)
+	startTime = time.Now()
+
+	// 只绑定在 127.0.0.1 上：-addr 127.0.0.1:2020
 	// 如果不指定 IP 会绑定到当前机器所有的 IP 上
-	listener, err := net.Listen("tcp", "127.0.0.1:2020")
 	// 同一个网络环境，如果要别的设备可访问的话，可以将 ip、端口设置为：0.0.0.0:2020
-	if err != nil {
-		panic(err)
+	var addrs addrList
+	flag.Var(&addrs, "addr", "监听地址，可重复指定或用逗号分隔，unix:/path 表示 UNIX socket（默认 127.0.0.1:2020）")
+	flag.Parse()
+	if err := loadConfigFile(); err != nil {
+		log.Fatalln("读取配置文件失败：", err)
+	}
+	if len(addrs) == 0 {
+		addrs = addrList{"127.0.0.1:2020"}
+	}
+	if err := setup(); err != nil {
+		log.Fatalln("参数错误：", err)
+	}
+	if *logFile != "" {
+		var err error
+		if serverLog, err = openLogFile(*logFile); err != nil {
+			log.Fatalln("打开日志文件失败：", err)
+		}
+		log.SetOutput(serverLog)
+	}
+	if serverLog != nil || *configFile != "" {
+		go handleHangup()
 	}
 
-	go broadcaster()
-
-	for {
-		conn, err := listener.Accept()
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		listener, err := listen(addr)
 		if err != nil {
-			log.Panicln(err)
-			continue
+			closeListeners(listeners)
+			panic(err)
 		}
-		go handleConn(conn)
+		listeners = append(listeners, listener)
+	}
+
+	go broadcaster()
+	startConnWorkers()
+
+	var httpServer, webServer *http.Server
+	if *httpAddr != "" {
+		httpServer = startHTTP(*httpAddr)
+	}
+	if *webAddr != "" {
+		webServer = startWeb(*webAddr)
+	}
+
+	// 每个监听地址一个 accept 循环，所有连接都交给同一个 broadcaster
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			acceptLoop(listener)
+		}(listener)
+	}
+
+	// 收到退出信号后关闭所有监听，UNIX socket 文件也会随之删除
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log.Println("正在关闭服务...")
+	closeListeners(listeners)
+	if httpServer != nil {
+		httpServer.Close()
+	}
+	if webServer != nil {
+		webServer.Close()
+	}
+	// 先断开所有用户，accept 循环可能正阻塞在 worker 队列上，要等连接处理完才能返回
+	shutdown()
+	wg.Wait()
+}
+
+// setup 在解析参数之后、启动 broadcaster 之前调用，检查参数并创建依赖参数的全局状态
+// 它不涉及监听和日志文件，进程内的测试或工具可以先调用 setup、启动 broadcaster，
+// 再把 net.Pipe() 等内存中的 net.Conn 交给 handleConn，模拟任意多个用户
+func setup() error {
+	if err := validateFlags(); err != nil {
+		return err
+	}
+	if err := registerExtCommands(); err != nil {
+		return err
+	}
+	if err := registerCustomAliases(); err != nil {
+		return err
+	}
+	if err := parseMessageTemplate(); err != nil {
+		return err
+	}
+	storeLimits()
+	messageChannel = make(chan *Message, *messageQueue)
+	if *maxHandshakes > 0 {
+		handshakeSlots = make(chan struct{}, *maxHandshakes)
 	}
+	return nil
+}
 
+// validateFlags 在启动时检查参数之间的约束，避免带着错误配置运行
+func validateFlags() error {
+	if *readBufferSize <= 0 || *maxLineSize <= 0 {
+		return errors.New("-read-buffer and -max-line must be positive")
+	}
+	if *maxLineSize < *readBufferSize {
+		return errors.New("-max-line must not be smaller than -read-buffer")
+	}
+	if *queueNotice <= 0 {
+		return errors.New("-queue-notice must be positive")
+	}
+	if *idleWarn < 0 || *idleWarn >= 1 {
+		return errors.New("-idle-warn must be in [0, 1)")
+	}
+	if *messageQueue < 0 || *messageQueueWait < 0 {
+		return errors.New("-message-queue and -message-queue-wait must not be negative")
+	}
+	switch *invalidUTF8 {
+	case utf8Replace, utf8Reject, utf8Allow:
+	default:
+		return errors.New("-invalid-utf8 must be one of replace, reject, allow")
+	}
+	if *maxHandshakes < 0 {
+		return errors.New("-max-concurrent-handshakes must not be negative")
+	}
+	if *connWorkers < 0 || *connBacklog < 0 {
+		return errors.New("-conn-workers and -conn-queue must not be negative")
+	}
+	if *nickGrace < 0 {
+		return errors.New("-nick-grace must not be negative")
+	}
+	if *maxRooms < 0 {
+		return errors.New("-max-rooms must not be negative")
+	}
+	return nil
+}
+
+// newChatState 创建 broadcaster 的初始状态；状态不依赖全局的 channel，可以单独构造后直接调用 broadcast 等方法测量投递性能
+// 开启了 -fanout-workers 时会启动投递 worker，broadcaster 之外单独构造的状态用完后要调用 close 让它们退出
+func newChatState() *chatState {
+	s := &chatState{
+		users: make(map[*User]struct{}),
+		nicks: make(map[string]*User),
+		rooms: make(map[string]*room),
+
+		admins: make(map[*User]struct{}),
+
+		inboxes:     make(map[string][]inboxMessage),
+		inboxOwners: make(map[string]inboxOwner),
+
+		reservedNicks: make(map[string]nickReservation),
+
+		stats: chatStats{roomMessages: make(map[string]int)},
+	}
+	if *fanoutWorkers > 0 {
+		s.pool = newFanoutPool(*fanoutWorkers)
+	}
+	return s
+}
+
+// close 停止投递 worker；broadcaster 的状态伴随整个进程，不需要调用
+func (s *chatState) close() {
+	if s.pool != nil {
+		s.pool.stop()
+		s.pool = nil
+	}
 }
 
 // broadcaster 用于记录聊天室用户，并进行消息广播：
@@ -60,45 +312,304 @@ func main() {
 // 负责登记/注销用户，通过 map 存储在线用户；
 // 用户登记、注销，使用专门的 channel。在注销时，除了从 map 中删除用户，还将 user 的 MessageChannel 关闭，避免上文提到的 goroutine 泄露问题；
 // 全局的 messageChannel 用来给聊天室所有用户广播消息；
+//
+// 顺序保证：所有广播都由这一个 goroutine 按 messageChannel 的先后处理，每个接收者的 MessageChannel 也是先进先出的，
+// 开启 -fanout-workers 时也会等本条消息投递完成再处理下一条，因此同一优先级的任意两条广播，每个接收者收到的先后顺序都相同
+// （高优先级的消息会插到积压的普通消息之前，见 priority.go），
+// 同一个发送者的消息按发出的顺序到达；/edit 等命令之前会先处理完已排队的消息（见 drainMessages）。
+// 不保证不丢：接收者过慢时 send 会丢弃消息，broadcaster 过载时 submitMessage 会丢弃新消息，丢弃只会留下空缺，不会打乱顺序，
+// 用户可以通过 /mystats 查看自己被丢弃的消息数。
 func broadcaster() {
-	users := make(map[*User]struct{})
+	s := newChatState()
+
+	queueTicker := time.NewTicker(*queueNotice)
+	defer queueTicker.Stop()
+	// 每秒执行一次的维护任务，如清理过期的消息
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
 
 	for {
 		select {
 		case user := <-enteringChannel:
-			// 新用户进入
-			users[user] = struct{}{}
+			s.drainMessages()
+			// 新用户进入，人数已满时排队或被拒绝
+			s.admit(user)
 		case user := <-leavingChannel:
+			s.drainMessages()
 			// 用户离开
-			delete(users, user)
+			s.leaveRoom(user)
+			delete(s.users, user)
+			s.removeAdmin(user)
+			if user.Nick != "" {
+				delete(s.nicks, strings.ToLower(user.Nick))
+			}
+			s.reserveNick(user, time.Now())
+			s.recordDeparture(user, time.Now())
+			s.recordInboxOwner(user, time.Now())
+			s.cancelScheduledFor(user)
 			// 避免 goroutine 泄露
-			close(user.MessageChannel)
-		case msg := <-messageChannel:
-			// 给所有在线用户发送消息
-			for user := range users {
-				user.MessageChannel <- msg
+			user.closeChannels()
+			// 离开提醒要在注销之后发出，否则自己会收到自己离开的提醒
+			// 被踢出的用户和服务关闭时不再逐个提醒，/kick、/kickall 和 shutdown 已经发过提醒
+			if !*quietJoins && !user.kicked.Load() && !shuttingDown.Load() {
+				notice := "user:`" + user.displayName() + "` has left"
+				if user.quitMessage != "" {
+					notice += " (" + user.quitMessage + ")"
+				}
+				s.broadcast(&Message{Content: notice})
 			}
+			// 空出位置后放行排队的用户
+			s.promoteWaiting()
+		case <-queueTicker.C:
+			s.notifyWaiting()
+		case now := <-tick.C:
+			s.pruneHistory(now)
+			s.expireTyping(now)
+			s.fireScheduled(now)
+			s.pruneInboxes(now)
+			s.pruneReservedNicks(now)
+		case msg := <-messageChannel:
+			s.handleMessage(msg)
+		case action := <-actionChannel:
+			s.drainMessages()
+			s.runAction(action)
+		}
+	}
+}
+
+// runAction 执行 handleConn 交给 broadcaster 的操作
+// 操作（比如命令处理）中出现的 panic 如果不恢复，会导致整个服务进程退出，这里记录日志后放弃这个操作，继续处理其他事件
+func (s *chatState) runAction(action func(s *chatState)) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("执行操作异常：%v\n%s", r, debug.Stack())
+		}
+	}()
+	action(s)
+}
+
+// drainMessages 先处理 messageChannel 中已经排队的消息
+// select 在多个 channel 同时就绪时是随机选择的，用户先发的消息可能还在缓冲中，
+// 处理同一用户后发的登记、注销和命令之前先清空缓冲，保证它们按用户发出的顺序生效
+func (s *chatState) drainMessages() {
+	for {
+		select {
+		case msg := <-messageChannel:
+			s.handleMessage(msg)
+		default:
+			return
+		}
+	}
+}
+
+// handleMessage 处理一条待广播的消息：用户消息只发给同一房间的用户，并记录到最近消息中
+func (s *chatState) handleMessage(msg *Message) {
+	if msg.From != nil && msg.Kind == "" {
+		if msg.Room == "" {
+			msg.Room = msg.From.Room
+		}
+		if r, ok := s.rooms[msg.Room]; ok && !s.allowPost(r, msg.From, msg.Time) {
+			return
 		}
+		msg.From.sentCount.Add(1)
+		s.stopTyping(msg.From)
+		s.record(msg)
+		s.countMessage(msg)
+		s.broadcast(msg)
+		s.autoReply(msg)
+		return
 	}
+	s.broadcast(msg)
 }
 
-func handleConn(conn net.Conn) {
+// broadcast 将消息格式化后发给消息所属房间的用户，没有指定房间时发给所有在线用户
+// 被 @ 提及的用户收到突出显示的提及消息，开启免打扰的用户只收到提及自己的消息
+// 每种格式只格式化一次，JSON 格式在有接收者需要时才生成，worker 并行投递时由 sync.OnceValue 保证只生成一次
+func (s *chatState) broadcast(msg *Message) {
+	mention := msg
+	mentioned := s.mentionedUsers(msg)
+	if len(mentioned) > 0 && msg.Kind == "" {
+		mention = &Message{Kind: kindMention, Seq: msg.Seq, From: msg.From, Room: msg.Room, Content: msg.Content, Time: msg.Time}
+	}
+	text, highlight := formatMessage(msg), formatMessage(mention)
+	jsonText := sync.OnceValue(func() string { return formatMessageJSON(msg) })
+	jsonHighlight := sync.OnceValue(func() string { return formatMessageJSON(mention) })
+
+	recipients := s.users
+	if msg.Room != "" {
+		r, ok := s.rooms[msg.Room]
+		if !ok {
+			return
+		}
+		recipients = r.members
+	}
+	send := s.send
+	if msg.Priority == priorityHigh {
+		send = s.sendPriority
+	}
+	s.fanout(recipients, func(user *User) {
+		// 关闭回显的用户不接收自己发言的副本，修改、删除等通知照常送达
+		if user.noEcho && msg.From == user && msg.Kind == "" {
+			return
+		}
+		// 暂停时丢弃广播并计数；每个用户只由一个 worker 处理，因此可以直接修改
+		// 高优先级的消息不受暂停和免打扰的影响
+		urgent := msg.Priority == priorityHigh || msg.From == user
+		if user.paused && !urgent {
+			user.missed++
+			return
+		}
+		if user.quiet && msg.From == nil && msg.Kind == "" && !urgent {
+			return
+		}
+		_, ok := mentioned[user]
+		if !ok && user.dnd && !urgent {
+			return
+		}
+		switch {
+		case ok && user.format == formatJSON:
+			send(user, jsonHighlight())
+		case ok:
+			send(user, highlight)
+		case user.format == formatJSON:
+			send(user, jsonText())
+		default:
+			send(user, text)
+		}
+	})
+}
+
+// lookupUser 根据 ID 或昵称查找在线用户，找不到时返回 nil
+func (s *chatState) lookupUser(idOrNick string) *User {
+	if id, err := strconv.Atoi(idOrNick); err == nil {
+		return s.userByID(id)
+	}
+	return s.nicks[strings.ToLower(idOrNick)]
+}
+
+// userByID 根据 ID 查找在线用户，找不到时返回 nil
+func (s *chatState) userByID(id int) *User {
+	for user := range s.users {
+		if user.ID == id {
+			return user
+		}
+	}
+	return nil
+}
+
+// send 给单个用户投递一行文本
+// 这里不能阻塞：某个用户接收过慢导致 MessageChannel 写满时，直接丢弃该消息，避免拖慢其他用户
+func (s *chatState) send(user *User, text string) {
+	select {
+	case user.MessageChannel <- text:
+		user.delivered()
+	default:
+		user.undelivered()
+	}
+}
+
+// formatMessage 把消息格式化成发给客户端的一行文本，用户消息的格式见 template.go
+func formatMessage(msg *Message) string {
+	switch {
+	case msg.Kind == kindEdit:
+		return "#" + strconv.Itoa(msg.Seq) + " edited by " + msg.From.label() + ": " + msg.Content
+	case msg.Kind == kindDelete:
+		return "#" + strconv.Itoa(msg.Seq) + " deleted by " + msg.From.label()
+	case msg.Kind == kindMention:
+		// 整行加粗，昵称颜色中的重置序列会打断加粗，因此这里不使用 label
+		return ansiBold + "#" + strconv.Itoa(msg.Seq) + " " + msg.From.displayName() + " mentioned you: " + msg.Content + ansiReset
+	case msg.Kind == kindTyping:
+		return msg.Content
+	case msg.Kind == kindReaction:
+		return "#" + strconv.Itoa(msg.Seq) + " reaction by " + msg.From.label() + ": " + msg.Content +
+			" (" + formatReactions(msg.Reactions) + ")"
+	case msg.From == nil:
+		return msg.Content
+	}
+
+	// 用户消息按 -message-template 格式化，回放历史时已经收到的表情回应也在其中
+	return formatUserMessage(msg)
+}
+
+// handleConn 处理一个连接的完整生命周期，release 在用户登记、被拒绝或进入排队后归还握手名额
+func handleConn(conn net.Conn, release func()) {
 	defer conn.Close()
+	defer release()
+	// 来源不被允许的连接直接关闭，不发送任何内容
+	if !allowConn(conn) {
+		return
+	}
+	tuneConn(conn)
 
 	// 1. 新用户进来，构建该用户的实例
 	user := &User{
 		ID:             genUserID(),
 		Addr:           conn.RemoteAddr().String(),
+		conn:           conn,
 		EnterAt:        time.Now(),
 		MessageChannel: make(chan string, 8),
+		admitted:       make(chan bool, 1),
+		queued:         make(chan struct{}, 1),
+
+		priorityChannel: make(chan string, 4),
+		briefGreeting:   !fullGreeting(time.Now()),
 	}
 
+	// 处理连接时（比如解析命令）出现的 panic 如果不恢复，会导致整个服务进程退出
+	// 这里记录日志后注销用户，再由上面的 defer 关闭连接，一个异常的连接不会影响其他用户
+	registered := false
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("处理连接异常：user %d (%s): %v\n%s", user.ID, user.Addr, r, debug.Stack())
+			if registered {
+				leavingChannel <- user
+			}
+		}
+	}()
+
 	// 2. 当前在一个新的 goroutine 中，用来进行读操作，因此需要开一个 goroutine 用于写操作
 	// 读写 goroutine 之间可以通过 channel 进行通信
-	go sendMessage(conn, user.MessageChannel)
+	writerDone := make(chan struct{})
+	go func() {
+		sendMessage(&meteredConn{Conn: conn, user: user}, user.MessageChannel, user.priorityChannel)
+		close(writerDone)
+	}()
+
+	// 握手的第一行告诉客户端服务端开启了哪些功能
+	if *advertiseCaps {
+		user.MessageChannel <- capabilities()
+	}
+
+	// 原始 telnet 客户端会发来协商序列，在分行之前去掉，见 telnet.go
+	// 判断 FORMAT 握手行时预读的数据放回输入的开头
+	var reader io.Reader = &telnetReader{r: conn}
+	prefix := peekFormat(conn, reader)
+	input := bufio.NewScanner(io.MultiReader(bytes.NewReader(prefix), reader))
+	input.Buffer(make([]byte, *readBufferSize), limits.Load().maxLine)
+
+	// 在欢迎信息和登记之前选择格式，回放的历史消息也按选择的格式发送
+	if string(prefix) == formatPrefix && !negotiateFormat(user, conn, input) {
+		user.closeChannels()
+		<-writerDone
+		log.Printf("user %d (%s) 没有发完 FORMAT 握手行，断开连接", user.ID, user.Addr)
+		return
+	}
 
-	// 3. 给当前用户发送欢迎信息
-	user.MessageChannel <- "欢迎你的到来：" + strconv.Itoa(user.ID)
+	// 开启了 -challenge 时，用户需要先通过验证才能进入；此时还没有登记，由这里关闭 MessageChannel
+	if *challenge && !passChallenge(user, conn, input) {
+		user.MessageChannel <- "challenge failed, bye"
+		user.closeChannels()
+		<-writerDone
+		log.Printf("user %d (%s) 未通过验证，断开连接", user.ID, user.Addr)
+		return
+	}
+
+	// 3. 给当前用户发送欢迎信息，用户还没有登记，可以直接按选择的格式格式化
+	user.MessageChannel <- formatFor(user, &Message{Content: "欢迎你的到来：" + strconv.Itoa(user.ID)})
+	// 新连接过多时和回放历史一样省略 MOTD，用户可以之后用 /motd 查看
+	if !user.briefGreeting {
+		sendMOTD(user)
+	}
 	// 知识点
 	// string 转成 int：
 	// int, err := strconv.Atoi(string)
@@ -109,26 +620,131 @@ func handleConn(conn net.Conn) {
 	// int64 转成 string：
 	// string := strconv.FormatInt(int64,10)
 
-	// 同时给聊天室所有用户发送有新用户到来的提醒；
-	messageChannel <- "user:`" + strconv.Itoa(user.ID) + "` has enter"
-
-	// 4. 将该记录到全局的用户列表中，避免用锁
-	// 注意，这里和 3）的顺序不能反，否则自己会收到自己到来的消息提醒；（当然，我们也可以做消息过滤处理）
+	// 4. 将该记录到全局的用户列表中，避免用锁，broadcaster 在登记时会给聊天室所有用户发送有新用户到来的提醒
+	// 人数已满时会在这里排队等待；被拒绝时 broadcaster 会关闭 MessageChannel，等提示发送完再断开连接
 	enteringChannel <- user
+	admitted, pending := waitAdmission(user, input, release)
+	release()
+	if !admitted {
+		<-writerDone
+		return
+	}
+	registered = true
 
-	// 5. 循环读取用户的输入
-	input := bufio.NewScanner(conn)
-	for input.Scan() {
-		messageChannel <- strconv.Itoa(user.ID) + ": " + input.Text()
+	// 5. 循环读取用户的输入，长时间没有输入时断开连接
+	// 排队期间开始的一次 Scan 可能还没有返回，先等它的结果
+	scan := func() bool {
+		if pending != nil {
+			ok := <-pending
+			pending = nil
+			return ok
+		}
+		return input.Scan()
 	}
+	idle := watchIdle(user, conn)
+	for scan() {
+		idle.touch()
+		inboundMessageBytes.observe(len(input.Bytes()))
+		user.bytesIn.Add(int64(len(input.Bytes())) + 1)
+		// scanner 的上限在连接建立时确定，运行时调小的 -max-line 在这里检查
+		if len(input.Bytes()) > limits.Load().maxLine {
+			log.Printf("user %d (%s) 的消息超过 -max-line，断开连接", user.ID, user.Addr)
+			break
+		}
+		if shuttingDown.Load() || user.kicked.Load() || user.overQuota.Load() || checkQuota(user, conn) {
+			break
+		}
+		line, ok := verifyLine(input.Text())
+		if !ok {
+			user.MessageChannel <- "integrity check failed, message dropped"
+			continue
+		}
+		if line, ok = checkUTF8(line); !ok {
+			user.MessageChannel <- "invalid UTF-8, message dropped"
+			continue
+		}
+		// /setmotd 粘贴模式下的输入都作为 MOTD，不进行广播
+		if handleMOTDPaste(user, line) {
+			continue
+		}
+		// json 格式的连接每一行都是一个 JSON 对象，指定了 cmd 时作为命令处理，否则 text 作为普通消息，不区分是否以 / 开头
+		// 其余连接以 / 开头的输入作为命令处理，不进行广播；以 // 开头是转义，去掉一个 / 后作为普通消息
+		if user.jsonInput {
+			in, err := parseJSONInput(line)
+			if err != nil {
+				replyError(user, "", err.Error())
+				continue
+			}
+			if in.Cmd != "" {
+				dispatchCommand(user, in.Cmd, in.args())
+				if user.quitting {
+					break
+				}
+				continue
+			}
+			line = in.Text
+		} else if strings.HasPrefix(line, "//") {
+			line = line[1:]
+		} else if strings.HasPrefix(line, "/") {
+			handleCommand(user, line)
+			if user.quitting {
+				break
+			}
+			continue
+		}
 
-	if err := input.Err(); err != nil {
+		// 只有空白的消息在合并之后直接丢弃
+		if *collapseSpace {
+			if line = collapseWhitespace(line); line == "" {
+				continue
+			}
+		}
+		if !allowMessage(user, time.Now()) {
+			continue
+		}
+
+		// broadcaster 处理不过来时丢弃这条消息，而不是让读循环一直阻塞，见 backpressure.go
+		if !submitMessage(&Message{From: user, Content: line, Time: time.Now()}) {
+			user.MessageChannel <- "server busy, message dropped"
+		}
+	}
+
+	idle.stop()
+	if shuttingDown.Load() {
+		// 关闭通知已经由 shutdown 广播过
+	} else if user.kicked.Load() {
+		log.Printf("user %d (%s) 被管理员踢出，断开连接", user.ID, user.Addr)
+	} else if user.overQuota.Load() {
+		// 同下面的空闲超时，发送缓冲区写满时放弃通知
+		select {
+		case user.MessageChannel <- "quota exceeded, disconnecting":
+		default:
+		}
+		log.Printf("user %d (%s) 收发字节数超过上限，断开连接", user.ID, user.Addr)
+	} else if err := input.Err(); errors.Is(err, os.ErrDeadlineExceeded) {
+		// 不能阻塞：用户的发送缓冲区可能已经写满，这时放弃通知直接断开
+		select {
+		case user.MessageChannel <- "disconnected due to inactivity":
+		default:
+		}
+		log.Printf("user %d (%s) 空闲超时，断开连接", user.ID, user.Addr)
+	} else if errors.Is(err, net.ErrClosed) {
+		// 写 goroutine 写入失败、或用户长时间无法接收消息时关闭了连接，已经记录过日志
+	} else if peerGone(err) {
+		log.Printf("user %d (%s) 的连接被对端重置", user.ID, user.Addr)
+	} else if err != nil {
 		log.Println("读取错误：", err)
 	}
 
-	// 6. 用户离开
+	// 6. 用户离开，broadcaster 注销用户后会给聊天室其他用户发送离开提醒
+	registered = false
 	leavingChannel <- user
-	messageChannel <- "user:`" + strconv.Itoa(user.ID) + "` has left"
+
+	// broadcaster 注销用户时会关闭 MessageChannel，稍等片刻让剩余的消息写完再断开连接
+	select {
+	case <-writerDone:
+	case <-time.After(time.Second):
+	}
 }
 
 func genUserID() int {
@@ -139,12 +755,93 @@ func genUserID() int {
 	return nextId
 }
 
+// peerGone 判断读写错误是否是对端已经断开（broken pipe、connection reset）
+// Go 运行时不会因为写入已断开的 socket 收到 SIGPIPE 而退出，只会返回 EPIPE 错误
+func peerGone(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// writeBufferSize 是每个连接写缓冲区的大小（字节），单条消息超过它时 bufio.Writer 会直接写出
+const writeBufferSize = 4096
+
 // channel 实际上有三种类型，大部分时候，我们只用了其中一种，就是正常的既能发送也能接收的 channel。
 // 除此之外还有单向的 channel：只能接收（<-chan，only receive）和只能发送（chan<-， only send）。
 // 它们没法直接创建，而是通过正常（双向）channel 转换而来（会自动隐式转换）。
 // 它们存在的价值，主要是避免 channel 被乱用。上面代码中 ch <-chan string 就是为了限制在 sendMessage 函数中只从 channel 读数据，不允许往里写数据。
-func sendMessage(conn net.Conn, ch <-chan string) {
-	for msg := range ch {
-		fmt.Fprintln(conn, msg)
+// 配置了 -hmac-key 时，多行消息的每一行都单独签名，客户端逐行校验
+// 每次取消息前先发完 priority 中排队的高优先级消息；ch 关闭后返回，关闭前 broadcaster 会先关闭 priority
+// 写入出错或只写了一部分时，不再往这个连接写任何内容，以免客户端收到残缺、错位的行：
+// 关闭连接让 handleConn 的读循环结束并注销用户，之后继续取出并丢弃消息，直到 ch 被关闭，避免发送方阻塞
+func sendMessage(conn net.Conn, ch <-chan string, priority <-chan string) {
+	// 消息先写入缓冲区，通道里暂时没有更多消息时再一次性发出，积压时多条消息合并成一次系统调用；
+	// 只要接下来要阻塞等待就会先刷新，因此缓冲不会推迟任何一条消息
+	w := bufio.NewWriterSize(conn, writeBufferSize)
+	var failed bool
+	fail := func(err error) {
+		failed = true
+		// 连接已经被关闭（如退出时强制关闭）时不必再记录；对端已经断开是常见情况，不当作错误
+		switch {
+		case errors.Is(err, net.ErrClosed):
+		case peerGone(err):
+			log.Printf("%s 已断开，停止写入：%v", conn.RemoteAddr(), err)
+		default:
+			log.Printf("写入 %s 失败，断开连接：%v", conn.RemoteAddr(), err)
+		}
+		// 关闭连接后读循环的 Scan 立即返回，由 handleConn 经 leavingChannel 注销用户，
+		// 不必等对端的 FIN 或空闲超时；这里不直接注销，避免和读循环重复注销
+		conn.Close()
+	}
+	// 缓冲区写满时 bufio.Writer 会自动写出，写出失败（包括短写）后的错误会一直保留，这里只需检查一次
+	write := func(msg string) {
+		if failed {
+			return
+		}
+		for _, line := range strings.Split(msg, "\n") {
+			w.WriteString(signLine(line))
+			if err := w.WriteByte('\n'); err != nil {
+				fail(err)
+				return
+			}
+		}
+	}
+	flush := func() {
+		if failed || w.Buffered() == 0 {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			fail(err)
+		}
+	}
+
+	for {
+		select {
+		case msg, ok := <-priority:
+			if ok {
+				write(msg)
+				continue
+			}
+			priority = nil
+		default:
+		}
+
+		// 两个通道都暂时没有消息，接下来要阻塞等待，先把缓冲区中的内容发出去
+		if len(ch) == 0 && len(priority) == 0 {
+			flush()
+		}
+
+		select {
+		case msg, ok := <-priority:
+			if ok {
+				write(msg)
+			} else {
+				priority = nil
+			}
+		case msg, ok := <-ch:
+			if !ok {
+				flush()
+				return
+			}
+			write(msg)
+		}
 	}
 }
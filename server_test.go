@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试在进程内启动 broadcaster，再把 net.Pipe() 的一端交给 handleConn，用另一端模拟客户端
+// 所有测试共用同一个 broadcaster，因此每个测试结束前都要断开自己的连接，消息内容也要带上测试名，避免和回放的历史混淆
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if err := setup(); err != nil {
+		log.Fatalln("参数错误：", err)
+	}
+	// 断开连接等日志对测试没有意义，-v 时才输出
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	go broadcaster()
+	os.Exit(m.Run())
+}
+
+// inBroadcaster 在 broadcaster 中执行 fn 并等待完成，用来读写只在 broadcaster 中访问的状态和参数
+func inBroadcaster(fn func(s *chatState)) {
+	done := make(chan struct{})
+	actionChannel <- func(s *chatState) {
+		fn(s)
+		close(done)
+	}
+	<-done
+}
+
+// testClient 是 net.Pipe() 上的模拟客户端，收到的每一行都放入 lines
+type testClient struct {
+	conn    net.Conn
+	lines   chan string
+	done    chan struct{} // done 在 handleConn 返回后关闭；
+	format  string        // format 是握手时选择的格式；
+	release chan struct{} // release 在 handleConn 归还握手名额时关闭；
+	welcome string        // welcome 是收到的欢迎信息；
+}
+
+// dial 建立一个文本格式的连接并等待欢迎信息，此时用户已经在等待登记，之后发出的行会在登记后处理
+func dial(t testing.TB) *testClient {
+	t.Helper()
+	return dialFormat(t, formatText)
+}
+
+// dialFormat 和 dial 一样，但先发送握手行选择格式；立即发送握手行也省去了 -format-wait 的等待
+func dialFormat(t testing.TB, format string) *testClient {
+	t.Helper()
+	server, client := net.Pipe()
+	c := &testClient{conn: client, lines: make(chan string, 1024), done: make(chan struct{}), format: format, release: make(chan struct{})}
+	var once sync.Once
+	go func() {
+		handleConn(server, func() { once.Do(func() { close(c.release) }) })
+		close(c.done)
+	}()
+	go func() {
+		input := bufio.NewScanner(client)
+		for input.Scan() {
+			c.lines <- input.Text()
+		}
+		close(c.lines)
+	}()
+	c.send(t, formatPrefix+format)
+	c.welcome = c.expect(t, "欢迎你的到来")
+	return c
+}
+
+// send 发送一行输入
+func (c *testClient) send(t testing.TB, line string) {
+	t.Helper()
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		t.Fatalf("发送 %q 失败：%v", line, err)
+	}
+}
+
+// expect 等待一行包含 want 的输出并返回，其间收到的其他行被跳过
+func (c *testClient) expect(t testing.TB, want string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				t.Fatalf("连接已关闭，没有收到 %q", want)
+			}
+			if strings.Contains(line, want) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("等待 %q 超时", want)
+		}
+	}
+}
+
+// sync 经由 broadcaster 往返一次，返回时用户已经登记，之前排队给该用户的消息也都已经收到
+func (c *testClient) sync(t testing.TB, nonce string) {
+	t.Helper()
+	if c.format == formatJSON {
+		c.send(t, `{"cmd":"ping","args":"`+nonce+`"}`)
+	} else {
+		c.send(t, "/ping "+nonce)
+	}
+	c.expect(t, "pong "+nonce)
+}
+
+// close 断开连接并等待 handleConn 返回
+func (c *testClient) close(t testing.TB) {
+	t.Helper()
+	c.conn.Close()
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("断开连接后 handleConn 没有返回")
+	}
+}
+
+func TestPipeConn(t *testing.T) {
+	c := dial(t)
+	defer c.close(t)
+
+	c.sync(t, t.Name())
+	c.send(t, "hello from "+t.Name())
+	c.expect(t, ": hello from "+t.Name())
+}
+
+func TestBroadcastHundredUsers(t *testing.T) {
+	clients := make([]*testClient, 100)
+	for i := range clients {
+		clients[i] = dial(t)
+		defer clients[i].close(t)
+	}
+	// 先等所有人登记完、收完进入提醒，广播时发送缓冲区都是空的，不会因为写满而丢弃
+	for i, c := range clients {
+		c.sync(t, t.Name()+strconv.Itoa(i))
+	}
+
+	text := "hello everyone from " + t.Name()
+	clients[0].send(t, text)
+	for _, c := range clients {
+		c.expect(t, ": "+text)
+	}
+}
+
+func TestNoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	clients := make([]*testClient, 20)
+	for i := range clients {
+		clients[i] = dial(t)
+	}
+	for i, c := range clients {
+		c.sync(t, t.Name()+strconv.Itoa(i))
+	}
+	for _, c := range clients {
+		c.close(t)
+	}
+
+	// 读 goroutine 和写 goroutine 在连接关闭后才陆续退出，稍等片刻再比较
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("断开所有连接后还有 %d 个 goroutine，连接前是 %d 个", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCommandPanic(t *testing.T) {
+	// 两个只在测试中注册的命令：一个在 handleConn 中 panic，一个在交给 broadcaster 的操作中 panic
+	registerCommand(&command{name: "testpanic", usage: "/testpanic", handler: func(*User, string) {
+		panic("testpanic")
+	}})
+	registerCommand(&command{name: "testpanicaction", usage: "/testpanicaction", handler: func(*User, string) {
+		actionChannel <- func(*chatState) { panic("testpanicaction") }
+	}})
+
+	watcher := dial(t)
+	defer watcher.close(t)
+	watcher.sync(t, t.Name())
+
+	// 在 broadcaster 中 panic 时只放弃这个操作，用户仍然在线
+	c := dial(t)
+	c.sync(t, t.Name()+"-before")
+	c.send(t, "/testpanicaction")
+	c.sync(t, t.Name()+"-after")
+
+	// 在 handleConn 中 panic 时注销这个用户并断开连接，其他用户不受影响
+	c.send(t, "/testpanic")
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleConn 中 panic 后连接没有断开")
+	}
+	c.conn.Close()
+
+	watcher.send(t, "still alive "+t.Name())
+	watcher.expect(t, ": still alive "+t.Name())
+}
+
+// 同一个发送者的消息都经过 messageChannel 和唯一的 broadcaster，每个接收者收到的顺序和发出的顺序一致
+func TestSenderOrder(t *testing.T) {
+	sender, receiver := dial(t), dial(t)
+	defer sender.close(t)
+	defer receiver.close(t)
+	sender.sync(t, t.Name())
+	receiver.sync(t, t.Name())
+
+	// 每批不超过接收者的发送缓冲区，读完一批再发下一批，消息不会因为接收者来不及读而被丢弃
+	const n, batch = 100, 4
+	prefix := t.Name() + " message "
+	for i := 0; i < n; i += batch {
+		for j := i; j < i+batch; j++ {
+			sender.send(t, prefix+strconv.Itoa(j))
+		}
+		for j := i; j < i+batch; j++ {
+			line := receiver.expect(t, prefix)
+			if want := prefix + strconv.Itoa(j); !strings.HasSuffix(line, ": "+want) {
+				t.Fatalf("message %d: got %q, want %q", j, line, want)
+			}
+		}
+	}
+}
+
+// flakyConn 写入 limit 个字节后出错，模拟只写了一部分就失败的连接
+type flakyConn struct {
+	net.Conn
+	limit   int
+	failed  bool
+	retries int // retries 是出错之后仍然调用 Write 的次数；
+}
+
+func (c *flakyConn) Write(p []byte) (int, error) {
+	if c.failed {
+		c.retries++
+		return 0, errors.New("flaky: write after failure")
+	}
+	if len(p) <= c.limit {
+		c.limit -= len(p)
+		return c.Conn.Write(p)
+	}
+	n, _ := c.Conn.Write(p[:c.limit])
+	c.failed = true
+	return n, errors.New("flaky: connection broke")
+}
+
+// 写入只完成一部分时，写 goroutine 不再写这个连接并关闭它，之后的消息直接丢弃，发送方不会被阻塞
+func TestShortWrite(t *testing.T) {
+	server, client := net.Pipe()
+	received := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(client)
+		received <- string(data)
+	}()
+
+	conn := &flakyConn{Conn: server, limit: 25}
+	ch, priority := make(chan string), make(chan string)
+	done := make(chan struct{})
+	go func() {
+		sendMessage(conn, ch, priority)
+		close(done)
+	}()
+
+	var sent strings.Builder
+	for i := 0; i < 20; i++ {
+		msg := "message " + strconv.Itoa(i)
+		ch <- msg
+		sent.WriteString(msg + "\n")
+	}
+	close(priority)
+	close(ch)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sendMessage did not return")
+	}
+
+	// 对端读到连接关闭，收到的是发出内容的前 limit 个字节
+	if got, want := <-received, sent.String()[:25]; got != want {
+		t.Fatalf("peer received %q, want %q", got, want)
+	}
+	if conn.retries != 0 {
+		t.Fatalf("%d writes after the failure", conn.retries)
+	}
+}
+
+// benchState 构造有 n 个用户的 chatState，每 slowEvery 个用户中有一个从不读取消息，发送缓冲区写满后消息被丢弃；0 表示都能及时读取
+// 开启了 -fanout-workers 时和 broadcaster 一样启动投递 worker
+func benchState(b *testing.B, n, slowEvery int) *chatState {
+	s := newChatState()
+	for i := 0; i < n; i++ {
+		user := &User{ID: i + 1, MessageChannel: make(chan string, 8), priorityChannel: make(chan string, 4)}
+		s.users[user] = struct{}{}
+		if slowEvery > 0 && i%slowEvery == 0 {
+			continue
+		}
+		go func() {
+			for range user.MessageChannel {
+			}
+		}()
+	}
+	b.Cleanup(func() {
+		s.close()
+		for user := range s.users {
+			close(user.MessageChannel)
+		}
+	})
+	return s
+}
+
+// BenchmarkBroadcast 测量一条消息广播给所有用户的开销，用 -benchmem 查看每次广播的内存分配
+func BenchmarkBroadcast(b *testing.B) {
+	tests := []struct {
+		name      string
+		users     int
+		slowEvery int
+		workers   int
+	}{
+		{"fast/100", 100, 0, 0},
+		{"fast/1000", 1000, 0, 0},
+		{"slow10pct/1000", 1000, 10, 0},
+		{"slow10pct/1000/workers4", 1000, 10, 4},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			defer func(workers, minUsers int) { *fanoutWorkers, *fanoutMin = workers, minUsers }(*fanoutWorkers, *fanoutMin)
+			*fanoutWorkers, *fanoutMin = tt.workers, 0
+
+			s := benchState(b, tt.users, tt.slowEvery)
+			var from *User
+			for user := range s.users {
+				from = user
+				break
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.broadcast(&Message{Seq: i + 1, From: from, Content: "hello everyone", Time: time.Now()})
+			}
+		})
+	}
+}
+
+// syncBuffer 是可以并发写入的缓冲区，用来收集日志
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// 对端在写入过程中重置连接时，写 goroutine 当作对端断开处理，关闭连接并停止写入
+func TestPeerClosesMidStream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	peer, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs syncBuffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	ch, priority := make(chan string, 64), make(chan string)
+	done := make(chan struct{})
+	go func() {
+		sendMessage(conn, ch, priority)
+		close(done)
+	}()
+	ch <- "hello"
+	if line, err := bufio.NewReader(peer).ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("peer read %q, %v", line, err)
+	}
+
+	// SO_LINGER 为 0 时 Close 发送 RST，之后的写入会得到 ECONNRESET 或 EPIPE
+	peer.(*net.TCPConn).SetLinger(0)
+	peer.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "已断开") {
+		if time.Now().After(deadline) {
+			t.Fatalf("writer did not notice the reset, logs: %q", logs.String())
+		}
+		ch <- strings.Repeat("x", 1024)
+		time.Sleep(time.Millisecond)
+	}
+	close(priority)
+	close(ch)
+	<-done
+
+	if _, err := conn.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("connection not closed after the reset: %v", err)
+	}
+}
+
+// countConn 统计 Write 的调用次数，每次 Write 对应一次系统调用
+type countConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(p)
+}
+
+// BenchmarkSendMessage 在消息积压时测量每条消息平均的写入次数：
+// direct 是不带缓冲、每条消息写一次的对照；sendMessage 只在通道暂时为空时才刷新缓冲区，writes/msg 远小于 1
+func BenchmarkSendMessage(b *testing.B) {
+	const msg = "#1 alice: hello, this is a benchmark message"
+	run := func(b *testing.B, send func(conn net.Conn, ch <-chan string)) {
+		server, client := net.Pipe()
+		defer client.Close()
+		go io.Copy(io.Discard, client)
+
+		conn := &countConn{Conn: server}
+		ch := make(chan string, 64)
+		done := make(chan struct{})
+		go func() {
+			send(conn, ch)
+			close(done)
+		}()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			ch <- msg
+		}
+		close(ch)
+		<-done
+		b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/msg")
+	}
+
+	b.Run("direct", func(b *testing.B) {
+		run(b, func(conn net.Conn, ch <-chan string) {
+			for msg := range ch {
+				io.WriteString(conn, msg+"\n")
+			}
+		})
+	})
+	b.Run("buffered", func(b *testing.B) {
+		run(b, func(conn net.Conn, ch <-chan string) {
+			priority := make(chan string)
+			close(priority)
+			sendMessage(conn, ch, priority)
+		})
+	})
+}
+
+// 以 // 开头的行是转义的普通消息，去掉一个 / 后广播，客户端 /sendfile 发送的 /quit 这样的行不会被执行
+func TestEscapedSlash(t *testing.T) {
+	c := dial(t)
+	defer c.close(t)
+	c.sync(t, t.Name())
+
+	c.send(t, "//quit "+t.Name())
+	c.expect(t, ": /quit "+t.Name())
+	c.send(t, "///already escaped "+t.Name())
+	c.expect(t, ": //already escaped "+t.Name())
+	c.sync(t, t.Name())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "退出时等待用户断开、剩余消息发完的最长时间，超时后强制关闭剩下的连接")
+
+// shuttingDown 在服务开始退出时设置，此后不再接受新用户，handleConn 读完当前一行后结束读循环
+var shuttingDown atomic.Bool
+
+// activeConns 记录所有交给 handleConn 的连接（包括还在 worker 队列中等待的），退出时用来等待和强制关闭
+var activeConns struct {
+	sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// trackConn 登记一个连接，返回的函数在 handleConn 返回后调用
+func trackConn(conn net.Conn) (done func()) {
+	activeConns.Lock()
+	if activeConns.conns == nil {
+		activeConns.conns = make(map[net.Conn]struct{})
+	}
+	activeConns.conns[conn] = struct{}{}
+	activeConns.Unlock()
+	activeConns.wg.Add(1)
+
+	return func() {
+		activeConns.Lock()
+		delete(activeConns.conns, conn)
+		activeConns.Unlock()
+		activeConns.wg.Done()
+	}
+}
+
+// shutdown 在关闭监听之后调用：通知所有用户服务即将关闭并让他们的读循环结束，
+// 等待每个连接注销、发完剩余消息，最多等 -shutdown-timeout，之后强制关闭还没有结束的连接
+func shutdown() {
+	shuttingDown.Store(true)
+	actionChannel <- func(s *chatState) {
+		// 排队中的用户直接拒绝，之后也不会再放行
+		for _, user := range s.waiting {
+			s.send(user, "server is shutting down")
+			user.admitted <- false
+			user.closeChannels()
+		}
+		s.waiting = nil
+
+		s.broadcast(&Message{Content: "server is shutting down", Time: time.Now(), Priority: priorityHigh})
+		for user := range s.users {
+			user.conn.SetReadDeadline(time.Now())
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		activeConns.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("所有连接都已正常断开")
+		return
+	case <-time.After(*shutdownTimeout):
+	}
+
+	activeConns.Lock()
+	n := len(activeConns.conns)
+	for conn := range activeConns.conns {
+		conn.Close()
+	}
+	activeConns.Unlock()
+	log.Printf("等待超过 %s，强制关闭了 %d 个连接", *shutdownTimeout, n)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /summary 统计最近多长时间内的消息数
+const summaryWindow = 5 * time.Minute
+
+// chatStats 是 broadcaster 维护的累计统计，只能在 broadcaster goroutine 中访问
+// 按房间的计数以房间名为 key，只保留现存的房间；房间被删除后计数并入 deletedRoomMessages，不会随着建过的房间数无限增长
+type chatStats struct {
+	totalMessages       int            // totalMessages 是累计广播的用户消息数；
+	totalConnections    int            // totalConnections 是累计进入聊天室的用户数；
+	roomMessages        map[string]int // roomMessages 是每个现存房间累计的用户消息数；
+	deletedRoomMessages int            // deletedRoomMessages 是已删除的房间累计的用户消息数；
+	resetAt             time.Time      // resetAt 是最近一次 /resetstats 的时间，零值表示从启动开始累计；
+}
+
+func init() {
+	registerCommand(&command{
+		name:    "stats",
+		usage:   "/stats",
+		desc:    "查看服务端的消息统计，包括每个房间的消息数",
+		handler: cmdStats,
+	})
+	registerCommand(&command{
+		name:    "summary",
+		usage:   "/summary",
+		desc:    "查看当前房间的概况：人数、最近消息中最活跃的用户、最近几分钟的消息数",
+		handler: cmdSummary,
+	})
+	registerCommand(&command{
+		name:      "resetstats",
+		usage:     "/resetstats",
+		desc:      "把 /stats 中的累计计数清零，用于从现在开始重新统计",
+		adminOnly: true,
+		handler:   cmdResetStats,
+	})
+}
+
+// countMessage 在用户消息广播时累加全局和房间的计数
+func (s *chatState) countMessage(msg *Message) {
+	s.stats.totalMessages++
+	s.stats.roomMessages[msg.Room]++
+}
+
+// dropRoom 在房间删除时把它的计数并入 deletedRoomMessages；之后重建的同名房间从零开始计数
+func (st *chatStats) dropRoom(name string) {
+	st.deletedRoomMessages += st.roomMessages[name]
+	delete(st.roomMessages, name)
+}
+
+// cmdStats 回复全局统计，以及按消息数从多到少排列的各房间统计
+func cmdStats(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		rooms := make([]string, 0, len(s.stats.roomMessages))
+		for name := range s.stats.roomMessages {
+			rooms = append(rooms, name)
+		}
+		sort.Slice(rooms, func(i, j int) bool {
+			ci, cj := s.stats.roomMessages[rooms[i]], s.stats.roomMessages[rooms[j]]
+			if ci != cj {
+				return ci > cj
+			}
+			return rooms[i] < rooms[j]
+		})
+
+		since := "since start"
+		if !s.stats.resetAt.IsZero() {
+			since = "since reset at " + s.stats.resetAt.Format(time.DateTime)
+		}
+		lines := []string{
+			"statistics " + since,
+			"online users: " + strconv.Itoa(len(s.users)) +
+				", total connections: " + strconv.Itoa(s.stats.totalConnections) +
+				", total messages: " + strconv.Itoa(s.stats.totalMessages),
+			"message queue: " + strconv.Itoa(len(messageChannel)) + "/" + strconv.Itoa(cap(messageChannel)) +
+				", full " + strconv.FormatInt(queueFullCount.Load(), 10) + " times" +
+				", dropped " + strconv.FormatInt(shedCount.Load(), 10) + " messages",
+		}
+		for _, name := range rooms {
+			lines = append(lines, "  "+name+": "+strconv.Itoa(s.stats.roomMessages[name])+" messages")
+		}
+		if s.stats.deletedRoomMessages > 0 {
+			lines = append(lines, "  deleted rooms: "+strconv.Itoa(s.stats.deletedRoomMessages)+" messages")
+		}
+		s.send(user, strings.Join(lines, "\n"))
+	}
+}
+
+// cmdResetStats 清零 broadcaster 维护的累计统计，以及消息队列的满载、丢弃计数
+// 在线人数来自 s.users，不是计数器，不受影响；/metrics 的指标按惯例单调递增，也不清零
+func cmdResetStats(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		if !s.requireAdmin(user, "resetstats") {
+			return
+		}
+		s.stats = chatStats{roomMessages: make(map[string]int), resetAt: time.Now()}
+		queueFullCount.Store(0)
+		shedCount.Store(0)
+		log.Printf("管理员 %d 清零了统计", user.ID)
+		s.send(user, "statistics reset")
+	}
+}
+
+// cmdSummary 私下回复当前房间的概况；活跃度只根据房间的最近消息（-history 条）计算，不会遍历更早的消息
+// 房间目前没有主题，因此概况里也没有主题
+func cmdSummary(user *User, _ string) {
+	actionChannel <- func(s *chatState) {
+		r := s.rooms[user.Room]
+		info := "room " + r.name + ": " + strconv.Itoa(len(r.members)) + " members"
+		if r.owner != nil {
+			info += ", owner " + r.owner.displayName()
+		}
+		if r.private {
+			info += ", private"
+		}
+		lines := []string{info}
+
+		now := time.Now()
+		counts := make(map[*User]int)
+		var top *User
+		recent := 0
+		for _, msg := range r.history {
+			counts[msg.From]++
+			if top == nil || counts[msg.From] > counts[top] || counts[msg.From] == counts[top] && msg.From.ID < top.ID {
+				top = msg.From
+			}
+			if now.Sub(msg.Time) < summaryWindow {
+				recent++
+			}
+		}
+		if top == nil {
+			lines = append(lines, "no recent messages")
+		} else {
+			lines = append(lines,
+				"most active in the last "+strconv.Itoa(len(r.history))+" messages: "+top.displayName()+" ("+strconv.Itoa(counts[top])+" messages)",
+				strconv.Itoa(recent)+" messages in the last "+summaryWindow.String())
+		}
+		lines = append(lines, "total messages in this room: "+strconv.Itoa(s.stats.roomMessages[r.name]))
+		s.send(user, strings.Join(lines, "\n"))
+	}
+}
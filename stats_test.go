@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+// 房间删除后按房间的计数并入 deletedRoomMessages，roomMessages 不会随着建过的房间数增长
+func TestStatsDropDeletedRooms(t *testing.T) {
+	s := newChatState()
+	defer s.close()
+	user := &User{ID: 1, MessageChannel: make(chan string, 8), priorityChannel: make(chan string, 4)}
+
+	for _, name := range []string{"a", "b", "a"} {
+		s.joinRoom(user, name)
+		s.countMessage(&Message{From: user, Room: name})
+		s.countMessage(&Message{From: user, Room: name})
+	}
+	if got := len(s.stats.roomMessages); got != 1 {
+		t.Fatalf("roomMessages has %d rooms, want 1: %v", got, s.stats.roomMessages)
+	}
+	if got := s.stats.roomMessages["a"]; got != 2 {
+		t.Errorf("recreated room a has %d messages, want 2", got)
+	}
+	if got := s.stats.deletedRoomMessages; got != 4 {
+		t.Errorf("deleted rooms have %d messages, want 4", got)
+	}
+	if got := s.stats.totalMessages; got != 6 {
+		t.Errorf("total messages = %d, want 6", got)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 状态最大长度（按字符计算）
+const maxStatusLen = 64
+
+func init() {
+	registerCommand(&command{
+		name:    "status",
+		usage:   "/status [text]",
+		desc:    "设置个人状态，显示在 /whois 和 /list 中，不带参数时清除",
+		handler: cmdStatus,
+	})
+}
+
+// stripControl 去掉文本中的控制字符（包括颜色转义的 ESC）和首尾空白，避免影响其他用户的终端
+func stripControl(text string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text))
+}
+
+// cmdStatus 设置或清除用户的状态
+func cmdStatus(user *User, args string) {
+	status := stripControl(args)
+	if utf8.RuneCountInString(status) > maxStatusLen {
+		replyError(user, "status", "status is too long, max "+strconv.Itoa(maxStatusLen)+" characters")
+		return
+	}
+
+	actionChannel <- func(s *chatState) {
+		user.status = status
+		if status == "" {
+			s.send(user, "status cleared")
+			return
+		}
+		s.send(user, "status set to: "+status)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+)
+
+// 每个 TCP 连接的参数，UNIX socket 和 WebSocket 连接不受影响
+var (
+	tcpNoDelay   = flag.Bool("tcp-nodelay", true, "关闭 Nagle 算法，聊天消息都很短，立即发送可以降低延迟")
+	tcpKeepAlive = flag.Duration("tcp-keepalive", 0, "TCP keepalive 探测间隔，0 表示使用默认值（15s），负数表示关闭")
+	tcpRcvBuf    = flag.Int("tcp-rcvbuf", 0, "TCP 接收缓冲区大小（字节），0 表示使用系统默认值")
+	tcpSndBuf    = flag.Int("tcp-sndbuf", 0, "TCP 发送缓冲区大小（字节），0 表示使用系统默认值")
+)
+
+// tuneConn 把 -tcp-* 参数应用到 TCP 连接上，不是 TCP 连接时直接返回；设置失败只记录日志，不影响连接
+func tuneConn(conn net.Conn) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	var errs []error
+	errs = append(errs, tcp.SetNoDelay(*tcpNoDelay))
+	switch {
+	case *tcpKeepAlive < 0:
+		errs = append(errs, tcp.SetKeepAlive(false))
+	case *tcpKeepAlive > 0:
+		errs = append(errs, tcp.SetKeepAlive(true), tcp.SetKeepAlivePeriod(*tcpKeepAlive))
+	}
+	if *tcpRcvBuf > 0 {
+		errs = append(errs, tcp.SetReadBuffer(*tcpRcvBuf))
+	}
+	if *tcpSndBuf > 0 {
+		errs = append(errs, tcp.SetWriteBuffer(*tcpSndBuf))
+	}
+	for _, err := range errs {
+		if err != nil {
+			log.Println("设置 TCP 参数失败：", conn.RemoteAddr(), err)
+		}
+	}
+}
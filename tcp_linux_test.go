@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sockopt 读取连接的一个整数选项
+func sockopt(t *testing.T, conn *net.TCPConn, level, opt int) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return value
+}
+
+func TestTuneConn(t *testing.T) {
+	defer func(noDelay bool, keepAlive time.Duration, rcvBuf, sndBuf int) {
+		*tcpNoDelay, *tcpKeepAlive, *tcpRcvBuf, *tcpSndBuf = noDelay, keepAlive, rcvBuf, sndBuf
+	}(*tcpNoDelay, *tcpKeepAlive, *tcpRcvBuf, *tcpSndBuf)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accept := func() *net.TCPConn {
+		t.Helper()
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn.(*net.TCPConn)
+	}
+
+	*tcpNoDelay, *tcpKeepAlive, *tcpRcvBuf, *tcpSndBuf = true, 42*time.Second, 64<<10, 128<<10
+	conn := accept()
+	tuneConn(conn)
+	if got := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); got == 0 {
+		t.Error("TCP_NODELAY is off")
+	}
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); got == 0 {
+		t.Error("SO_KEEPALIVE is off")
+	}
+	if got := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); got != 42 {
+		t.Errorf("TCP_KEEPIDLE = %d, want 42", got)
+	}
+	// Linux 会把设置的缓冲区大小翻倍，用来存放内核的簿记数据
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF); got < 64<<10 {
+		t.Errorf("SO_RCVBUF = %d, want at least %d", got, 64<<10)
+	}
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF); got < 128<<10 {
+		t.Errorf("SO_SNDBUF = %d, want at least %d", got, 128<<10)
+	}
+
+	*tcpNoDelay, *tcpKeepAlive, *tcpRcvBuf, *tcpSndBuf = false, -1, 0, 0
+	conn = accept()
+	tuneConn(conn)
+	if got := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); got != 0 {
+		t.Error("TCP_NODELAY is on with -tcp-nodelay=false")
+	}
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); got != 0 {
+		t.Error("SO_KEEPALIVE is on with a negative -tcp-keepalive")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import "io"
+
+// telnet 协议的命令字节，见 RFC 854
+const (
+	telnetSE   = 240 // 子协商结束；
+	telnetSB   = 250 // 子协商开始；
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255 // IAC 之后的字节是命令，IAC IAC 表示数据中的 0xFF；
+)
+
+// telnetReader 的解析状态，跨多次 Read 保留，协商序列被拆在两次读取之间时也能正确去掉
+const (
+	telnetData   = iota // 普通数据；
+	telnetCmd           // 读到 IAC，等待命令字节；
+	telnetOption        // 读到 WILL/WONT/DO/DONT，等待选项字节；
+	telnetSub           // 在子协商中，等待 IAC SE；
+	telnetSubIAC        // 子协商中读到 IAC；
+)
+
+// telnetReader 去掉输入中的 telnet 协商序列（IAC ...），用原始 telnet 客户端连接时，
+// 这些字节不会被当作消息内容广播出去；协商请求一律不回应，telnet 客户端会按默认的行模式工作
+// 合法的 UTF-8 中不会出现 0xFF，因此对普通客户端和 WebSocket 用户没有影响
+type telnetReader struct {
+	r     io.Reader
+	state int
+}
+
+func (t *telnetReader) Read(p []byte) (int, error) {
+	for {
+		n, err := t.r.Read(p)
+		n = t.strip(p[:n])
+		// 整块都是协商序列时继续读，避免返回 0, nil 让 bufio.Scanner 误以为没有进展
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// strip 原地去掉 buf 中的协商序列，返回剩下的数据长度
+func (t *telnetReader) strip(buf []byte) int {
+	n := 0
+	for _, b := range buf {
+		switch t.state {
+		case telnetData:
+			if b == telnetIAC {
+				t.state = telnetCmd
+				continue
+			}
+			buf[n] = b
+			n++
+		case telnetCmd:
+			switch {
+			case b == telnetIAC:
+				buf[n] = b
+				n++
+				t.state = telnetData
+			case b == telnetSB:
+				t.state = telnetSub
+			case b >= telnetWILL && b <= telnetDONT:
+				t.state = telnetOption
+			default:
+				// 其余都是两个字节的命令，如 NOP、AYT
+				t.state = telnetData
+			}
+		case telnetOption:
+			t.state = telnetData
+		case telnetSub:
+			if b == telnetIAC {
+				t.state = telnetSubIAC
+			}
+		case telnetSubIAC:
+			if b == telnetSE {
+				t.state = telnetData
+			} else {
+				t.state = telnetSub
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestTelnetStrip(t *testing.T) {
+	const iac, will, do, sb, se, nop = "\xff", "\xfb", "\xfd", "\xfa", "\xf0", "\xf1"
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello\n", "hello\n"},
+		{"options", iac + do + "\x01" + iac + will + "\x03hello\n", "hello\n"},
+		{"two-byte command", "hel" + iac + nop + "lo\n", "hello\n"},
+		{"subnegotiation", iac + sb + "\x18\x00xterm" + iac + se + "hello\n", "hello\n"},
+		{"IAC inside subnegotiation", iac + sb + "\x18" + iac + iac + "x" + iac + se + "hi\n", "hi\n"},
+		{"escaped IAC", "a" + iac + iac + "b\n", "a\xffb\n"},
+	}
+	for _, tt := range tests {
+		// 整块输入
+		r := &telnetReader{}
+		buf := []byte(tt.in)
+		if got := string(buf[:r.strip(buf)]); got != tt.want {
+			t.Errorf("%s: strip(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+
+		// 逐字节输入，序列被拆在多次读取之间
+		r = &telnetReader{}
+		var got []byte
+		for i := 0; i < len(tt.in); i++ {
+			b := []byte{tt.in[i]}
+			got = append(got, b[:r.strip(b)]...)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: byte-at-a-time strip(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultMessageTemplate 和引入模板之前的格式一致：#序号 昵称: 正文，带上阅后即焚时长和表情回应
+const defaultMessageTemplate = `#{{.Seq}} {{.Nick}}: {{.Text}}{{if .TTL}} [ttl {{.TTL}}]{{end}}{{if .Reactions}} [{{.Reactions}}]{{end}}`
+
+var messageTemplateText = flag.String("message-template", defaultMessageTemplate,
+	"用户消息的文本格式，使用 text/template 语法，可用字段：.Seq .ID .Name .Nick（带颜色）.Room .Text .Time .TTL .Reactions，"+
+		`例如 "{{.Time.Format \"15:04\"}} <{{.Nick}}> {{.Text}}"；系统通知、修改、删除等提示不受影响`)
+
+var (
+	defaultTemplate = template.Must(template.New("message").Parse(defaultMessageTemplate))
+	messageTemplate = defaultTemplate // messageTemplate 是解析后的 -message-template，由 setup 设置；
+)
+
+// messageView 是执行消息模板时的数据，只包含格式化需要的字段
+type messageView struct {
+	Seq       int       // Seq 是消息序号；
+	ID        int       // ID 是发送者的用户 ID；
+	Name      string    // Name 是发送者的昵称或 ID，不带颜色；
+	Nick      string    // Nick 和 Name 相同，但设置了昵称颜色或开启 -color 时带 ANSI 颜色；
+	Room      string    // Room 是消息所在的房间；
+	Text      string    // Text 是消息正文；
+	Time      time.Time // Time 是服务端收到消息的时间；
+	TTL       string    // TTL 是阅后即焚消息的存活时间，普通消息为空；
+	Reactions string    // Reactions 是已经收到的表情回应，没有时为空；
+}
+
+// parseMessageTemplate 解析 -message-template，并用一条示例消息试执行，模板写错时在启动阶段就报错
+func parseMessageTemplate() error {
+	tmpl, err := template.New("message").Parse(*messageTemplateText)
+	if err != nil {
+		return errors.New("-message-template: " + err.Error())
+	}
+
+	now := time.Now()
+	sample := &Message{
+		Seq:       1,
+		From:      &User{ID: 1, Nick: "sample"},
+		Room:      lobbyRoom,
+		Content:   "hello",
+		Time:      now,
+		Expires:   now.Add(time.Minute),
+		Reactions: map[string]map[int]struct{}{"+1": {1: {}}},
+	}
+	if err := tmpl.Execute(&strings.Builder{}, newMessageView(sample)); err != nil {
+		return errors.New("-message-template: " + err.Error())
+	}
+	messageTemplate = tmpl
+	return nil
+}
+
+// newMessageView 从用户消息构造模板数据，只能在 broadcaster 中调用
+func newMessageView(msg *Message) messageView {
+	v := messageView{
+		Seq:  msg.Seq,
+		ID:   msg.From.ID,
+		Name: msg.From.displayName(),
+		Nick: msg.From.label(),
+		Room: msg.Room,
+		Text: msg.Content,
+		Time: msg.Time,
+	}
+	if !msg.Expires.IsZero() {
+		v.TTL = msg.Expires.Sub(msg.Time).Round(time.Second).String()
+	}
+	if len(msg.Reactions) > 0 {
+		v.Reactions = formatReactions(msg.Reactions)
+	}
+	return v
+}
+
+// formatUserMessage 用 -message-template 格式化一条用户消息
+// 模板已经在启动时试执行过，个别消息仍然执行出错时记录日志并退回默认格式
+func formatUserMessage(msg *Message) string {
+	v := newMessageView(msg)
+	var b strings.Builder
+	if err := messageTemplate.Execute(&b, v); err != nil {
+		log.Println("执行消息模板失败：", err)
+		b.Reset()
+		defaultTemplate.Execute(&b, v)
+	}
+	return b.String()
+}
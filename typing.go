@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 客户端在用户输入时发送 /typing，broadcaster 为每个房间维护正在输入的用户集合，
+// 集合变化时给房间里的每个用户发送一条汇总提示，如 "alice, bob are typing..."，提示中不包括接收者自己。
+// 为了避免提示刷屏，每个房间每 -typing-debounce 最多更新一次，期间的变化由每秒的维护任务补发；
+// 超过 -typing-expire 没有新的 /typing 时视为停止输入，所有人都停止输入时发送 "nobody is typing" 清除提示
+var (
+	typingDebounce = flag.Duration("typing-debounce", 3*time.Second, "同一房间两次“正在输入”提示之间的最小间隔")
+	typingExpire   = flag.Duration("typing-expire", 5*time.Second, "收到 /typing 后超过该时长没有再次收到，视为停止输入")
+)
+
+// typingNamesShown 是汇总提示中最多列出的名字个数，其余的显示为人数
+const typingNamesShown = 3
+
+func init() {
+	registerCommand(&command{
+		name:    "typing",
+		usage:   "/typing",
+		desc:    "告知同一房间的用户自己正在输入，一般由客户端自动发送",
+		handler: cmdTyping,
+	})
+}
+
+func cmdTyping(user *User, _ string) {
+	now := time.Now()
+	actionChannel <- func(s *chatState) {
+		r, ok := s.rooms[user.Room]
+		if !ok {
+			return
+		}
+		user.typingUntil = now.Add(*typingExpire)
+		if _, ok := r.typing[user]; ok {
+			return
+		}
+		r.typing[user] = struct{}{}
+		r.typingDirty = true
+		s.flushTyping(r, now)
+	}
+}
+
+// stopTyping 在用户发言时清除其输入状态
+func (s *chatState) stopTyping(user *User) {
+	r, ok := s.rooms[user.Room]
+	if !ok {
+		return
+	}
+	if _, ok := r.typing[user]; ok {
+		delete(r.typing, user)
+		r.typingDirty = true
+		s.flushTyping(r, time.Now())
+	}
+}
+
+// expireTyping 由每秒的维护任务调用，清除过期的输入状态，并补发因去抖而推迟的提示
+func (s *chatState) expireTyping(now time.Time) {
+	for _, r := range s.rooms {
+		for user := range r.typing {
+			if !now.Before(user.typingUntil) {
+				delete(r.typing, user)
+				r.typingDirty = true
+			}
+		}
+		s.flushTyping(r, now)
+	}
+}
+
+// flushTyping 在房间的输入状态有变化且不在去抖间隔内时，给房间里的用户发送新的汇总提示
+// 每个用户记录自己最近看到的提示，内容没变时不重复发送；暂停和免打扰的用户不接收输入提示
+func (s *chatState) flushTyping(r *room, now time.Time) {
+	if !r.typingDirty || now.Sub(r.typingEmit) < *typingDebounce {
+		return
+	}
+	r.typingDirty = false
+	r.typingEmit = now
+
+	typists := make([]*User, 0, len(r.typing))
+	for user := range r.typing {
+		typists = append(typists, user)
+	}
+	sort.Slice(typists, func(i, j int) bool { return typists[i].ID < typists[j].ID })
+
+	for member := range r.members {
+		if member.paused || member.dnd {
+			continue
+		}
+		text := typingText(typists, member)
+		if text == member.typingSeen {
+			continue
+		}
+		member.typingSeen = text
+		if text == "" {
+			text = "nobody is typing"
+		}
+		s.send(member, formatFor(member, &Message{Kind: kindTyping, Room: r.name, Content: text, Time: now}))
+	}
+}
+
+// typingText 生成给 viewer 看的汇总提示，不包括 viewer 自己，没有其他人在输入时返回空字符串
+func typingText(typists []*User, viewer *User) string {
+	names := make([]string, 0, len(typists))
+	for _, user := range typists {
+		if user != viewer {
+			names = append(names, user.displayName())
+		}
+	}
+	switch {
+	case len(names) == 0:
+		return ""
+	case len(names) == 1:
+		return names[0] + " is typing..."
+	case len(names) > typingNamesShown:
+		return strings.Join(names[:typingNamesShown], ", ") + " and " + strconv.Itoa(len(names)-typingNamesShown) + " others are typing..."
+	}
+	return strings.Join(names, ", ") + " are typing..."
+}
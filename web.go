@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var webAddr = flag.String("web-addr", "", "网页客户端的监听地址（如 127.0.0.1:8081），浏览器通过 /ws 的 WebSocket 接入聊天室，为空表示不启用")
+
+// WebSocket 协议（RFC 6455）中用到的常量
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// startWeb 启动网页客户端，/ 返回聊天页面，/ws 把 WebSocket 连接桥接成普通用户
+func startWeb(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, webPage)
+	})
+	mux.HandleFunc("/ws", handleWebSocket)
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		log.Println("网页客户端监听：", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("网页客户端异常退出：", err)
+		}
+	}()
+	return srv
+}
+
+// handleWebSocket 完成 WebSocket 握手，之后把连接包装成 net.Conn 交给 handleConn，和 TCP 用户走同一套流程
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "expected websocket upgrade", http.StatusBadRequest)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	serveConn(&wsConn{Conn: conn, br: rw.Reader}, acquireHandshake())
+}
+
+// wsConn 把一个 WebSocket 连接适配成按行读写的 net.Conn：
+// 读取时每条文本消息后补一个换行，写入时每个完整的行作为一条文本消息发出
+// 地址、超时等其余方法直接使用底层连接的实现
+type wsConn struct {
+	net.Conn
+	br      *bufio.Reader
+	pending []byte
+	partial []byte     // partial 是上次 Write 末尾还没有换行的部分，只在写 goroutine 中使用；
+	wmu     sync.Mutex // wmu 保护写操作，读 goroutine 回复 pong 时也会写；
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		op, payload, fin, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case wsOpText, wsOpBinary, wsOpContinuation:
+			c.pending = append(c.pending, payload...)
+			if fin {
+				c.pending = append(c.pending, '\n')
+			}
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return 0, err
+			}
+		case wsOpClose:
+			c.writeFrame(wsOpClose, nil)
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write 按换行拆分，每行单独作为一条文本消息，末尾不完整的一行留到下次 Write 再发
+// sendMessage 带缓冲写入，一次 Write 可能包含多行，也可能在一行甚至一个 UTF-8 字符的中间截断，
+// 而浏览器要求每条文本消息都是完整的 UTF-8，否则以 1007 关闭连接
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.partial = append(c.partial, p...)
+	start := 0
+	for {
+		i := bytes.IndexByte(c.partial[start:], '\n')
+		if i < 0 {
+			break
+		}
+		if err := c.writeFrame(wsOpText, c.partial[start:start+i]); err != nil {
+			return 0, err
+		}
+		start += i + 1
+	}
+	c.partial = append(c.partial[:0], c.partial[start:]...)
+	return len(p), nil
+}
+
+// readFrame 读取一个客户端数据帧，客户端发来的帧必须带掩码
+func (c *wsConn) readFrame() (op byte, payload []byte, fin bool, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0f
+	if head[1]&0x80 == 0 {
+		err = errors.New("websocket: client frame is not masked")
+		return
+	}
+
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > uint64(limits.Load().maxLine) {
+		err = errors.New("websocket: frame too large")
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// writeFrame 发送一个不分片、不带掩码的服务端数据帧
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	frame := []byte{0x80 | op}
+	switch size := len(payload); {
+	case size < 126:
+		frame = append(frame, byte(size))
+	case size <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(size))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(size))
+	}
+	frame = append(frame, payload...)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// webPage 是一个最简单的网页客户端
+const webPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>chatroom</title>
+<style>
+body { font-family: monospace; margin: 1em; }
+#log { white-space: pre-wrap; height: 80vh; overflow-y: auto; border: 1px solid #ccc; padding: .5em; }
+#input { width: 100%; margin-top: .5em; }
+</style>
+</head>
+<body>
+<div id="log"></div>
+<input id="input" autofocus placeholder="输入消息或 /命令，回车发送">
+<script>
+const log = document.getElementById("log");
+const input = document.getElementById("input");
+const ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/ws");
+function show(text) {
+  log.textContent += text.replace(/\x1b\[[0-9;]*m/g, "") + "\n";
+  log.scrollTop = log.scrollHeight;
+}
+ws.onmessage = e => show(e.data);
+ws.onclose = () => show("*** disconnected ***");
+input.addEventListener("keydown", e => {
+  if (e.key === "Enter" && input.value !== "") {
+    ws.send(input.value);
+    input.value = "";
+  }
+});
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// readServerFrame 读取一个服务端发出的、不带掩码的短文本帧
+func readServerFrame(t *testing.T, r io.Reader) string {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	if head[0] != 0x80|wsOpText || head[1] >= 126 {
+		t.Fatalf("unexpected frame header % x", head)
+	}
+	payload := make([]byte, head[1])
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return string(payload)
+}
+
+// sendMessage 的缓冲区可能在任意位置截断，每个完整的行仍然要单独成帧
+func TestWSConnWriteLines(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &wsConn{Conn: server}
+
+	go func() {
+		defer server.Close()
+		// "中" 是 e4 b8 ad，这里在字符中间截断
+		for _, chunk := range []string{"one\ntwo\nth", "ree\n\xe4\xb8", "\xad\n", "\n"} {
+			if _, err := c.Write([]byte(chunk)); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, want := range []string{"one", "two", "three", "中", ""} {
+		if got := readServerFrame(t, client); got != want {
+			t.Fatalf("frame = %q, want %q", got, want)
+		}
+	}
+}